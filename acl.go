@@ -0,0 +1,212 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+)
+
+// aclPerm describes the kind of access a command needs
+type aclPerm int
+
+const (
+	permNone aclPerm = iota
+	permAdd
+	permConsume
+	permAdmin
+)
+
+var permNames = map[aclPerm]string{
+	permAdd:     "add",
+	permConsume: "consume",
+	permAdmin:   "admin",
+}
+
+func (perm aclPerm) String() string {
+	return permNames[perm]
+}
+
+// Errors which may be returned to clients when access control is enabled
+var (
+	errNoAuth      = errors.New("authentication required")
+	errInvalidAuth = errors.New("invalid username or password")
+	errNoACL       = errors.New("AUTH called but no access control is configured")
+)
+
+// acl is set from --acl-file. If it's nil then access control is disabled, and
+// all clients may run all commands.
+var acl *aclConfig
+
+// aclConfig describes which users may connect, and what each of them may do
+type aclConfig struct {
+	Users map[string]*aclUser `json:"users"`
+}
+
+type aclUser struct {
+	Password string    `json:"password"`
+	Rules    []aclRule `json:"rules"`
+}
+
+// aclRule grants a set of permissions on all queues whose names match the
+// Queues pattern. If Groups is set the permissions are only granted for
+// commands acting on a consumer group whose name matches it, and not for
+// commands acting on a queue as a whole. Patterns use the syntax of path.Match.
+type aclRule struct {
+	Queues      string   `json:"queues"`
+	Groups      string   `json:"groups"`
+	Permissions []string `json:"permissions"`
+}
+
+// aclTarget is a queue, and optionally one of its consumer groups, which a
+// command acts on
+type aclTarget struct {
+	queue, group string
+}
+
+func loadACL(filename string) (*aclConfig, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var a aclConfig
+	if err := json.Unmarshal(b, &a); err != nil {
+		return nil, err
+	}
+
+	validPerms := map[string]bool{}
+	for _, name := range permNames {
+		validPerms[name] = true
+	}
+	for name, u := range a.Users {
+		if u == nil {
+			return nil, fmt.Errorf("user %q has no configuration", name)
+		} else if u.Password == "" {
+			return nil, fmt.Errorf("user %q has no password", name)
+		}
+		for _, rule := range u.Rules {
+			for _, pattern := range []string{rule.Queues, rule.Groups} {
+				if _, err := path.Match(pattern, ""); err != nil {
+					return nil, fmt.Errorf("user %q has invalid pattern %q: %s", name, pattern, err)
+				}
+			}
+			for _, perm := range rule.Permissions {
+				if !validPerms[perm] {
+					return nil, fmt.Errorf("user %q has unknown permission %q", name, perm)
+				}
+			}
+		}
+	}
+
+	return &a, nil
+}
+
+// auth returns the user with the given name, if the given password is correct
+// for them
+func (a *aclConfig) auth(name, password string) (*aclUser, error) {
+	u, ok := a.Users[name]
+	if !ok || subtle.ConstantTimeCompare([]byte(u.Password), []byte(password)) != 1 {
+		return nil, errInvalidAuth
+	}
+	return u, nil
+}
+
+func (rule aclRule) allows(perm aclPerm, t aclTarget) bool {
+	hasPerm := false
+	for _, name := range rule.Permissions {
+		hasPerm = hasPerm || name == perm.String()
+	}
+	if !hasPerm {
+		return false
+	}
+
+	if ok, _ := path.Match(rule.Queues, t.queue); !ok {
+		return false
+	}
+	if rule.Groups == "" {
+		return true
+	} else if t.group == "" {
+		return false
+	}
+	ok, _ := path.Match(rule.Groups, t.group)
+	return ok
+}
+
+// allowsAll returns whether the rule gives the permission on every queue,
+// rather than only those matching some pattern
+func (rule aclRule) allowsAll(perm aclPerm) bool {
+	return rule.Queues == "*" && rule.Groups == "" && rule.allows(perm, aclTarget{queue: "*"})
+}
+
+// aclTargets returns what the given command acts on. A nil return means the
+// command acts on all queues. Assumes the command has at least its minimum
+// number of arguments.
+func aclTargets(cmd string, perm aclPerm, args []string) []aclTarget {
+	switch {
+	case cmd == "QSTATUS" || cmd == "QINFO":
+		qcg, err := argsToQCG(args)
+		if err != nil {
+			// Malformed arguments are left to dispatch, which rejects them
+			// without acting on any queue
+			return []aclTarget{}
+		}
+		var tt []aclTarget
+		for q, cgs := range qcg {
+			if len(cgs) == 0 {
+				tt = append(tt, aclTarget{queue: q})
+			}
+			for _, cg := range cgs {
+				tt = append(tt, aclTarget{queue: q, group: cg})
+			}
+		}
+		return tt
+	case perm == permConsume || cmd == "QDELGROUP" || cmd == "QCONSUMERS":
+		return []aclTarget{{queue: args[0], group: args[1]}}
+	default:
+		return []aclTarget{{queue: args[0]}}
+	}
+}
+
+// authorize returns an error if the given user, which is nil if the client
+// hasn't authenticated, may not run the given command. The error should be
+// returned to the client. Always returns nil if access control is disabled.
+func authorize(u *aclUser, cmd string, args []string) error {
+	if acl == nil {
+		return nil
+	}
+
+	// Unknown commands and missing arguments are left to dispatch
+	fn, ok := dispatchTable[cmd]
+	if !ok || len(args) < fn.minArgs || fn.perm == permNone {
+		return nil
+	} else if u == nil {
+		return errNoAuth
+	}
+
+	tt := aclTargets(cmd, fn.perm, args)
+	if tt == nil {
+		for _, rule := range u.Rules {
+			if rule.allowsAll(fn.perm) {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s permission required on all queues", fn.perm)
+	}
+
+outer:
+	for _, t := range tt {
+		for _, rule := range u.Rules {
+			if rule.allows(fn.perm, t) {
+				continue outer
+			}
+		}
+		if t.group != "" {
+			return fmt.Errorf("%s permission required on queue %q consumer group %q", fn.perm, t.queue, t.group)
+		}
+		return fmt.Errorf("%s permission required on queue %q", fn.perm, t.queue)
+	}
+	return nil
+}
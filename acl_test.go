@@ -0,0 +1,104 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	. "testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadACL(t *T) {
+	load := func(body string) (*aclConfig, error) {
+		f, err := ioutil.TempFile("", "bananaq-acl")
+		require.Nil(t, err)
+		defer os.Remove(f.Name())
+		_, err = f.WriteString(body)
+		require.Nil(t, err)
+		require.Nil(t, f.Close())
+		return loadACL(f.Name())
+	}
+
+	a, err := load(`{"users":{"alice":{"password":"foo","rules":[{"queues":"a-*","permissions":["add","consume"]}]}}}`)
+	require.Nil(t, err)
+	assert.Equal(t, "foo", a.Users["alice"].Password)
+	assert.Equal(t, []aclRule{{Queues: "a-*", Permissions: []string{"add", "consume"}}}, a.Users["alice"].Rules)
+
+	_, err = load(`{"users":{"alice":{"password":"foo","rules":[{"queues":"*","permissions":["read"]}]}}}`)
+	assert.NotNil(t, err)
+
+	_, err = load(`{"users":{"alice":{"password":"foo","rules":[{"queues":"[","permissions":["add"]}]}}}`)
+	assert.NotNil(t, err)
+
+	_, err = load(`{"users":{"alice":{"rules":[{"queues":"*","permissions":["add"]}]}}}`)
+	assert.NotNil(t, err)
+
+	_, err = load(`{"users":{"alice":{"password":"","rules":[{"queues":"*","permissions":["add"]}]}}}`)
+	assert.NotNil(t, err)
+}
+
+func TestAuthorize(t *T) {
+	acl = &aclConfig{
+		Users: map[string]*aclUser{
+			"producer": {
+				Password: "p",
+				Rules: []aclRule{
+					{Queues: "a-*", Permissions: []string{"add"}},
+				},
+			},
+			"consumer": {
+				Password: "c",
+				Rules: []aclRule{
+					{Queues: "a-*", Groups: "workers-*", Permissions: []string{"consume", "admin"}},
+				},
+			},
+			"admin": {
+				Password: "a",
+				Rules: []aclRule{
+					{Queues: "*", Permissions: []string{"add", "consume", "admin"}},
+				},
+			},
+		},
+	}
+	defer func() { acl = nil }()
+
+	_, err := acl.auth("producer", "c")
+	assert.Equal(t, errInvalidAuth, err)
+	_, err = acl.auth("nobody", "")
+	assert.Equal(t, errInvalidAuth, err)
+
+	producer, err := acl.auth("producer", "p")
+	require.Nil(t, err)
+	consumer, err := acl.auth("consumer", "c")
+	require.Nil(t, err)
+	admin, err := acl.auth("admin", "a")
+	require.Nil(t, err)
+
+	allowed := func(u *aclUser, cmd string, args ...string) bool {
+		return authorize(u, cmd, args) == nil
+	}
+
+	assert.Equal(t, errNoAuth, authorize(nil, "QADD", []string{"a-foo", "30", "bar"}))
+	assert.True(t, allowed(nil, "PING"))
+	assert.True(t, allowed(nil, "QADD"), "missing args are left to dispatch")
+
+	assert.True(t, allowed(producer, "QADD", "a-foo", "30", "bar"))
+	assert.False(t, allowed(producer, "QADD", "b-foo", "30", "bar"))
+	assert.False(t, allowed(producer, "QGET", "a-foo", "workers-1"))
+
+	assert.True(t, allowed(consumer, "QGET", "a-foo", "workers-1"))
+	assert.True(t, allowed(consumer, "QDELGROUP", "a-foo", "workers-1"))
+	assert.True(t, allowed(consumer, "QCONSUMERS", "a-foo", "workers-1"))
+	assert.False(t, allowed(consumer, "QCONSUMERS", "a-foo", "other"))
+	assert.False(t, allowed(consumer, "QGET", "a-foo", "other"))
+	assert.False(t, allowed(consumer, "QADD", "a-foo", "30", "bar"))
+	assert.False(t, allowed(consumer, "QPURGE", "a-foo"))
+	assert.True(t, allowed(consumer, "QSTATUS", "QUEUE", "a-foo", "GROUP", "workers-1"))
+	assert.False(t, allowed(consumer, "QSTATUS", "QUEUE", "a-foo"))
+	assert.False(t, allowed(consumer, "QSTATUS"))
+
+	assert.True(t, allowed(admin, "QDEL", "b-foo"))
+	assert.True(t, allowed(admin, "QSTATUS"))
+	assert.True(t, allowed(admin, "QINFO", "QUEUE", "a-foo", "QUEUE", "b-foo"))
+}
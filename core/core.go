@@ -157,38 +157,104 @@ func (ts TS) String() string {
 // the TS returned might differ in the time it represents from the given TS by a
 // very small amount (or a big amount, if the given time is way in the past).
 func (c Core) MonoTS(t TS) (TS, error) {
+	return c.monoTS(t, 1)
+}
+
+// the key holding the newest TS handed out by MonoTS, and the key holding all
+// TSs which have been reserved by ReserveTS. The second is given a hash tag so
+// that both will always be in the same slot in a cluster.
+func (c Core) monoTSKeys() (string, string) {
+	idKey := c.o.RedisPrefix + ":monots"
+	return idKey, "{" + idKey + "}:reserved"
+}
+
+// monoTS is like MonoTS, but reserves n consecutive TSs at once and returns the
+// first of them. The caller is free to use the returned TS and the n-1 TSs
+// following it.
+func (c Core) monoTS(t TS, n uint64) (TS, error) {
 	lua := `
 		local key = KEYS[1]
-		local now_raw = ARGV[1]
-		local now = cmsgpack.unpack(now_raw)
+		local reservedKey = KEYS[2]
+		local now = cmsgpack.unpack(ARGV[1])
+		local n = tonumber(ARGV[2])
 		local last_raw = redis.call("GET", key)
 
-		if not last_raw then
-			redis.call("SET", key, now_raw)
-			return now_raw
+		local first = now
+		if last_raw then
+			local last = cmsgpack.unpack(last_raw)
+			-- Add a microsecond and use that
+			if last >= now then first = last + 1 end
 		end
 
-		local last = cmsgpack.unpack(last_raw)
-		if last < now then
-			redis.call("SET", key, now_raw)
-			return now_raw
+		-- Reservations older than first will never be handed out again, so
+		-- there's no need to keep them around. Any which fall within the range
+		-- we're returning must be skipped over.
+		local function tsStr(ts) return string.format("%.0f", ts) end
+		redis.call("ZREMRANGEBYSCORE", reservedKey, "-inf", "(" .. tsStr(first))
+		local i = 0
+		while i < n do
+			if redis.call("ZSCORE", reservedKey, tsStr(first + i)) then
+				first = first + i + 1
+				i = 0
+			else
+				i = i + 1
+			end
 		end
 
-		-- Add a microsecond and use that
-		last = last + 1
-		last_raw = cmsgpack.pack(last)
-		redis.call("SET", key, last_raw)
-		return last_raw
+		redis.call("SET", key, cmsgpack.pack(first + n - 1))
+		return cmsgpack.pack(first)
 	`
 
-	idKey := c.o.RedisPrefix + ":monots"
+	idKey, reservedKey := c.monoTSKeys()
 
 	var ib []byte
 	var err error
 	withMarshaled(func(bb [][]byte) {
 		nowb := bb[0]
-		ib, err = util.LuaEval(c.c, lua, 1, idKey, nowb).Bytes()
+		ib, err = util.LuaEval(c.c, lua, 2, idKey, reservedKey, nowb, n).Bytes()
+	}, t)
+	if err != nil {
+		return 0, err
+	}
+
+	var t2 TS
+	_, err = t2.UnmarshalMsg(ib)
+	return t2, err
+}
+
+// ReserveTS returns a unique TS corresponding to the given timestamp, which may
+// be in the future. The returned TS will never be returned by MonoTS or
+// ReserveTS again, but unlike MonoTS the returns from ReserveTS are not
+// monotonically increasing. If the given TS isn't newer than the last one
+// returned by MonoTS this behaves exactly like MonoTS.
+func (c Core) ReserveTS(t TS) (TS, error) {
+	lua := `
+		local key = KEYS[1]
+		local reservedKey = KEYS[2]
+		local t = cmsgpack.unpack(ARGV[1])
+		local last_raw = redis.call("GET", key)
+		if last_raw and cmsgpack.unpack(last_raw) >= t then return false end
+
+		local function tsStr(ts) return string.format("%.0f", ts) end
+		while redis.call("ZSCORE", reservedKey, tsStr(t)) do t = t + 1 end
+		redis.call("ZADD", reservedKey, tsStr(t), tsStr(t))
+		return cmsgpack.pack(t)
+	`
+
+	idKey, reservedKey := c.monoTSKeys()
+
+	var r *redis.Resp
+	withMarshaled(func(bb [][]byte) {
+		r = util.LuaEval(c.c, lua, 2, idKey, reservedKey, bb[0])
 	}, t)
+	if r.IsType(redis.Nil) {
+		return c.MonoTS(t)
+	}
+
+	ib, err := r.Bytes()
+	if err != nil {
+		return 0, err
+	}
 
 	var t2 TS
 	_, err = t2.UnmarshalMsg(ib)
@@ -230,6 +296,10 @@ func IDFromString(idstr string) (ID, error) {
 type Event struct {
 	ID       ID
 	Contents string
+
+	// Optional metadata about the event, e.g. a content-type or trace id. It is
+	// stored alongside Contents and is never interpreted by bananaq
+	Headers map[string]string
 }
 
 // NewEvent initializes an event struct with the given information, as well as
@@ -251,6 +321,46 @@ func (c *Core) NewEvent(now, expire TS, contents string) (Event, error) {
 	}, nil
 }
 
+// NewScheduledEvent is like NewEvent, but the returned Event's ID will be based
+// on the given at time instead of the current time. at may be in the future.
+// See ReserveTS for more.
+func (c *Core) NewScheduledEvent(at, expire TS, contents string) (Event, error) {
+	atRes, err := c.ReserveTS(at)
+	if err != nil {
+		return Event{}, err
+	}
+
+	return Event{
+		ID:       ID{atRes, expire},
+		Contents: contents,
+	}, nil
+}
+
+// NewEvents is like NewEvent, but creates one Event for each of the given
+// contents, all sharing the same expire. The returned Events are in the same
+// order as the given contents, with each one's ID being newer than the last.
+// Only a single round-trip to redis is made regardless of how many Events are
+// created.
+func (c *Core) NewEvents(now, expire TS, contents []string) ([]Event, error) {
+	if len(contents) == 0 {
+		return []Event{}, nil
+	}
+
+	first, err := c.monoTS(now, uint64(len(contents)))
+	if err != nil {
+		return nil, err
+	}
+
+	ee := make([]Event, len(contents))
+	for i := range contents {
+		ee[i] = Event{
+			ID:       ID{first + TS(i), expire},
+			Contents: contents[i],
+		}
+	}
+	return ee, nil
+}
+
 func pexpireAt(t TS, buffer time.Duration) int64 {
 	return t.Time().Add(buffer).UnixNano() / 1e6 // to millisecond
 }
@@ -264,20 +374,54 @@ func (c *Core) eventKey(id ID) string {
 // event will expire based on the ID field in it (which will be truncated to an
 // integer) added with the given buffer
 func (c *Core) SetEvent(e Event, expireBuffer time.Duration) error {
-	pex := pexpireAt(e.ID.Expire, expireBuffer)
+	return c.SetEvents([]Event{e}, expireBuffer)
+}
+
+// SetEvents is like SetEvent, but sets all of the given events at once. When
+// not using a cluster this will only make a single round-trip to redis.
+func (c *Core) SetEvents(ee []Event, expireBuffer time.Duration) error {
+	if len(ee) == 0 {
+		return nil
+	}
+
+	// Every event has its own key, and in a cluster those keys are almost
+	// certainly spread across different nodes, so they can't all be set in a
+	// single call
+	if _, ok := c.c.(*cluster.Cluster); ok && len(ee) > 1 {
+		for i := range ee {
+			if err := c.SetEvents(ee[i:i+1], expireBuffer); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
 	lua := `
-		local key = KEYS[1]
-		local pexpire = ARGV[1]
-		local val = ARGV[2]
-		redis.call("SET", key, val)
-		redis.call("PEXPIREAT", key, pexpire)
+		for i = 1,#KEYS do
+			local pexpire = ARGV[(i*2)-1]
+			local val = ARGV[i*2]
+			redis.call("SET", KEYS[i], val)
+			redis.call("PEXPIREAT", KEYS[i], pexpire)
+		end
 	`
 
+	mm := make([]msgp.Marshaler, len(ee))
+	for i := range ee {
+		mm[i] = &ee[i]
+	}
+
 	var err error
 	withMarshaled(func(bb [][]byte) {
-		eb := bb[0]
-		err = util.LuaEval(c.c, lua, 1, c.eventKey(e.ID), pex, eb).Err
-	}, &e)
+		args := make([]interface{}, 0, len(ee)*3)
+		for i := range ee {
+			args = append(args, c.eventKey(ee[i].ID))
+		}
+		for i := range ee {
+			pex := pexpireAt(ee[i].ID.Expire, expireBuffer)
+			args = append(args, pex, bb[i])
+		}
+		err = util.LuaEval(c.c, lua, len(ee), args...).Err
+	}, mm...)
 	return err
 }
 
@@ -299,6 +443,80 @@ func (c *Core) GetEvent(id ID) (Event, error) {
 	return e, err
 }
 
+// GetEvents is like GetEvent, but retrieves multiple events at once. The
+// returned events will be in the same order as the given IDs. Events which are
+// expired or never existed are left out of the return, rather than causing
+// ErrNotFound to be returned. When not using a cluster this will only make a
+// single round-trip to redis.
+func (c *Core) GetEvents(ii []ID) ([]Event, error) {
+	ee := make([]Event, 0, len(ii))
+
+	// See SetEvents for why a cluster is special
+	if _, ok := c.c.(*cluster.Cluster); ok && len(ii) > 1 {
+		for _, id := range ii {
+			e, err := c.GetEvent(id)
+			if err == ErrNotFound {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			ee = append(ee, e)
+		}
+		return ee, nil
+	} else if len(ii) == 0 {
+		return ee, nil
+	}
+
+	keys := make([]string, len(ii))
+	for i := range ii {
+		keys[i] = c.eventKey(ii[i])
+	}
+
+	rr, err := c.c.Cmd("MGET", keys).Array()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range rr {
+		if r.IsType(redis.Nil) {
+			continue
+		}
+		eb, err := r.Bytes()
+		if err != nil {
+			return nil, err
+		}
+		var e Event
+		if _, err = e.UnmarshalMsg(eb); err != nil {
+			return nil, err
+		}
+		ee = append(ee, e)
+	}
+	return ee, nil
+}
+
+// DelEvents deletes the events identified by the given IDs. IDs for events
+// which are expired or never existed are ignored. When not using a cluster this
+// will only make a single round-trip to redis.
+func (c *Core) DelEvents(ii []ID) error {
+	// See SetEvents for why a cluster is special
+	if _, ok := c.c.(*cluster.Cluster); ok && len(ii) > 1 {
+		for i := range ii {
+			if err := c.DelEvents(ii[i : i+1]); err != nil {
+				return err
+			}
+		}
+		return nil
+	} else if len(ii) == 0 {
+		return nil
+	}
+
+	keys := make([]string, len(ii))
+	for i := range ii {
+		keys[i] = c.eventKey(ii[i])
+	}
+	return c.c.Cmd("DEL", keys).Err
+}
+
 // Key describes a location some data can be stored in in redis. Keys with the
 // same Base will be stored together and can be interacted with transactionally.
 // Subs is used a further set of identifiers for the Key.
@@ -387,6 +605,30 @@ type QueryIDScoreSelect struct {
 	Equal TS
 }
 
+// QueryExcessSelect selects the IDs which would have to be removed from a Key
+// for it to fit within the given limits, if its newest IDs are the ones kept.
+// The Key's IDs are taken in the order they're stored in it, oldest first, so
+// each ID's score in it should be its T. IDs in Keep are never selected, though
+// they still count towards the limits.
+//
+// MaxCount limits the number of IDs in the Key. MaxSum limits the total weight
+// of the IDs in the Key, where each ID's weight is its score in SumKey. The
+// total is read from SumTotalKey, which must be kept up to date using
+// QueryTally. A limit of zero is ignored.
+//
+// Only the IDs which are selected are read from the Key, so this is cheap no
+// matter how large the Key is.
+type QueryExcessSelect struct {
+	MaxCount int64
+	MaxSum   int64
+
+	// Only required if MaxSum is set
+	SumKey      Key
+	SumTotalKey Key
+
+	Keep []ID
+}
+
 // QuerySelector describes a set of criteria for selecting a set of IDs from a
 // Key. Key is a required field, only one field apart from it should be set in
 // this selector (unless otherwise noted)
@@ -399,6 +641,9 @@ type QuerySelector struct {
 	// See QueryIDScoreSelect doc string
 	*QueryIDScoreSelect
 
+	// See QueryExcessSelect doc string
+	*QueryExcessSelect
+
 	// Select IDs by their position within the Key, using a two element
 	// slice. 0 is the oldest id, 1 is the second oldest, etc... -1 is the
 	// youngest, -2 the second youngest, etc...
@@ -424,6 +669,12 @@ type QueryFilter struct {
 	// If set, only IDs which have not expired will be allowed through
 	Expired bool
 
+	// If set, only IDs which are either not in the given Key, or are in it
+	// with a score which doesn't fall within ScoreRange, will be allowed
+	// through. MinFromInput and MaxFromInput are not supported on ScoreRange.
+	InKey      *Key
+	ScoreRange QueryScoreRange
+
 	// May be set alongside any other filter field. Will invert the filter, so
 	// that whatever IDs would have been allowed through will not be, and
 	// vice-versa
@@ -457,10 +708,15 @@ type QueryConditional struct {
 // true, then each ID's expire time will be used as its score. If Score is given
 // it will be used as the score for all IDs being added, otherwise the T of
 // each individual ID will be used
+//
+// If Incr is set then the score is added to each ID's existing score in the
+// Keys, instead of replacing it. IDs not already in a Key are treated as having
+// a score of zero.
 type QueryAddTo struct {
 	Keys          []Key
 	ExpireAsScore bool
 	Score         TS
+	Incr          bool
 }
 
 // QueryRemoveByScore is used to remove IDs from Keys based on a range of
@@ -471,15 +727,35 @@ type QueryRemoveByScore struct {
 	QueryScoreRange
 }
 
+// QueryTally keeps a running total of the scores of the IDs in Key, so that it
+// doesn't have to be summed by reading every ID (see QueryExcessSelect). The
+// scores which the input IDs have in Key are added to the total held in
+// TotalKey, or subtracted from it if Decr is set. IDs which aren't in Key are
+// ignored, so this must be done after IDs are added to Key and before they're
+// removed from it. The input is passed through as the output.
+type QueryTally struct {
+	Key
+	TotalKey Key
+	Decr     bool
+}
+
 // QuerySingleSet will set the given Key to the first ID in the input. If the
 // input to this action has no IDs then nothing happens.  The output from this
 // action will be the input.
 //
 // If IfNewer is set, the key will only be set if its ID is newer than the ID
 // already in the Key. This does not change the output in any way
+//
+// If Newest is set, the last (i.e. newest) ID in the input will be used instead
+// of the first
+//
+// If ExpireAt is set, the Key will be removed entirely once that time is
+// reached
 type QuerySingleSet struct {
 	Key
-	IfNewer bool
+	IfNewer  bool
+	Newest   bool
+	ExpireAt TS
 }
 
 // QueryAction describes a single action to take on a set of IDs. Every action
@@ -500,6 +776,10 @@ type QueryAction struct {
 	// that count to the result, and pass that input through as the output.
 	CountInput bool
 
+	// If greater than zero, only the first LimitInput IDs of the input will be
+	// passed through as the output, the rest are discarded.
+	LimitInput int64
+
 	// Adds the input IDs to the given Keys. See its doc string for more info
 	*QueryAddTo
 
@@ -509,6 +789,9 @@ type QueryAction struct {
 	// Removes the input IDs from the given Keys
 	RemoveFrom []Key
 
+	// Adjusts a running total of scores. See its doc string for more info
+	*QueryTally
+
 	// Adds an ID to a key. See its doc string for more info
 	*QuerySingleSet
 
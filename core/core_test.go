@@ -1,6 +1,7 @@
 package core
 
 import (
+	"os"
 	. "testing"
 	"time"
 
@@ -10,10 +11,33 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
+// testCore is only set if BANANAQ_TEST_REDIS is set to the address of a redis
+// instance to test against, see requireRedis
 var testCore *Core
 
+// testBackend is what the tests which don't depend on redis itself are run
+// against. It's a Mem, unless testCore is set in which case it's testCore
+var testBackend interface {
+	MonoTS(TS) (TS, error)
+	ReserveTS(TS) (TS, error)
+	NewEvent(now, expire TS, contents string) (Event, error)
+	NewEvents(now, expire TS, contents []string) ([]Event, error)
+	SetEvent(Event, time.Duration) error
+	SetEvents([]Event, time.Duration) error
+	GetEvent(ID) (Event, error)
+	GetEvents([]ID) ([]Event, error)
+	DelEvents([]ID) error
+	Query(QueryActions) (QueryRes, error)
+	KeyScan(Key) ([]Key, error)
+} = NewMem()
+
 func init() {
-	p, err := pool.New("tcp", "127.0.0.1:6379", 1)
+	addr := os.Getenv("BANANAQ_TEST_REDIS")
+	if addr == "" {
+		return
+	}
+
+	p, err := pool.New("tcp", addr, 1)
 	if err != nil {
 		panic(err)
 	}
@@ -22,9 +46,18 @@ func init() {
 	})
 	errCh := testCore.Run(nil)
 	go func() { panic(<-errCh) }()
+	testBackend = testCore
+}
+
+// requireRedis skips the calling test if testCore isn't available
+func requireRedis(t *T) {
+	if testCore == nil {
+		t.Skip("BANANAQ_TEST_REDIS not set")
+	}
 }
 
 func TestMonoTS(t *T) {
+	requireRedis(t)
 	for i := 0; i < 100; i++ {
 		now := time.Now()
 		nowTS := NewTS(now)
@@ -47,8 +80,36 @@ func TestMonoTS(t *T) {
 	}
 }
 
+func TestReserveTS(t *T) {
+	requireRedis(t)
+	futureTS := NewTS(time.Now().Add(50 * time.Millisecond))
+
+	rTS, err := testCore.ReserveTS(futureTS)
+	require.Nil(t, err)
+	assert.Equal(t, futureTS, rTS)
+
+	rTS, err = testCore.ReserveTS(futureTS)
+	require.Nil(t, err)
+	assert.Equal(t, futureTS+1, rTS)
+
+	// MonoTS should skip over the reserved TSs
+	mTS, err := testCore.MonoTS(futureTS)
+	require.Nil(t, err)
+	assert.Equal(t, futureTS+2, mTS)
+
+	// Now that futureTS is no longer newer than what MonoTS has returned,
+	// ReserveTS should behave like MonoTS
+	rTS, err = testCore.ReserveTS(futureTS)
+	require.Nil(t, err)
+	assert.Equal(t, futureTS+3, rTS)
+
+	// Wait for futureTS to actually pass, so other tests don't get TSs from the
+	// future
+	time.Sleep(100 * time.Millisecond)
+}
+
 func requireNewID(t *T) ID {
-	ts, err := testCore.MonoTS(NewTS(time.Now()))
+	ts, err := testBackend.MonoTS(NewTS(time.Now()))
 	require.Nil(t, err)
 	return ID{
 		T:      ts,
@@ -65,7 +126,7 @@ func randKey(base string) Key {
 
 func populatedKey(t *T, base string, ii ...ID) Key {
 	k := randKey(base)
-	_, err := testCore.Query(QueryActions{
+	_, err := testBackend.Query(QueryActions{
 		KeyBase: k.Base,
 		QueryActions: []QueryAction{
 			{
@@ -92,7 +153,7 @@ func randPopulatedKey(t *T, base string, size int) (Key, []ID) {
 }
 
 func assertKey(t *T, k Key, ii ...ID) {
-	res, err := testCore.Query(QueryActions{
+	res, err := testBackend.Query(QueryActions{
 		KeyBase: k.Base,
 		QueryActions: []QueryAction{
 			{
@@ -114,10 +175,20 @@ func assertKey(t *T, k Key, ii ...ID) {
 
 // Assert the contents of a set as well as its scores
 func assertKeyRaw(t *T, k Key, ixm map[ID]int64) {
+	m := map[ID]int64{}
+	if mem, ok := testBackend.(*Mem); ok {
+		mem.l.Lock()
+		for id, score := range mem.zsets[memKey(k)] {
+			m[id] = int64(score)
+		}
+		mem.l.Unlock()
+		assert.Equal(t, ixm, m)
+		return
+	}
+
 	arr, err := testCore.c.Cmd("ZRANGE", k.String(testCore.o.RedisPrefix), 0, -1, "WITHSCORES").Array()
 	require.Nil(t, err)
 
-	m := map[ID]int64{}
 	for i := 0; i < len(arr); i += 2 {
 		ib, err := arr[i].Bytes()
 		require.Nil(t, err)
@@ -138,20 +209,80 @@ func TestGetSetEvent(t *T) {
 	now := time.Now()
 	expire := time.Now().Add(500 * time.Millisecond)
 
-	e, err := testCore.NewEvent(NewTS(now), NewTS(expire), contents)
+	e, err := testBackend.NewEvent(NewTS(now), NewTS(expire), contents)
 	require.Nil(t, err)
 
-	assert.Nil(t, testCore.SetEvent(e, 500*time.Millisecond))
-	e2, err := testCore.GetEvent(e.ID)
+	assert.Nil(t, testBackend.SetEvent(e, 500*time.Millisecond))
+	e2, err := testBackend.GetEvent(e.ID)
 	assert.Nil(t, err)
 	assert.Equal(t, e, e2)
 
+	// Headers should be stored alongside the event
+	eh, err := testBackend.NewEvent(NewTS(now), NewTS(expire), contents)
+	require.Nil(t, err)
+	eh.Headers = map[string]string{"trace-id": testutil.RandStr()}
+	assert.Nil(t, testBackend.SetEvent(eh, 500*time.Millisecond))
+	eh2, err := testBackend.GetEvent(eh.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, eh, eh2)
+
 	time.Sleep(1*time.Second + 100*time.Millisecond)
-	_, err = testCore.GetEvent(e.ID)
+	_, err = testBackend.GetEvent(e.ID)
 	assert.Equal(t, ErrNotFound, err)
 }
 
+func TestNewSetEvents(t *T) {
+	contents := []string{testutil.RandStr(), testutil.RandStr(), testutil.RandStr()}
+	now := time.Now()
+	expire := time.Now().Add(1 * time.Minute)
+
+	ee, err := testBackend.NewEvents(NewTS(now), NewTS(expire), contents)
+	require.Nil(t, err)
+	require.Len(t, ee, len(contents))
+	for i := range ee {
+		assert.Equal(t, contents[i], ee[i].Contents)
+		assert.Equal(t, NewTS(expire), ee[i].ID.Expire)
+		if i > 0 {
+			assert.True(t, ee[i].ID.T > ee[i-1].ID.T)
+		}
+	}
+
+	// Make sure the reserved TSs actually got reserved
+	mTS, err := testBackend.MonoTS(NewTS(now))
+	require.Nil(t, err)
+	assert.True(t, mTS > ee[len(ee)-1].ID.T)
+
+	require.Nil(t, testBackend.SetEvents(ee, 0))
+	for _, e := range ee {
+		e2, err := testBackend.GetEvent(e.ID)
+		assert.Nil(t, err)
+		assert.Equal(t, e, e2)
+	}
+}
+
+func TestDelEvents(t *T) {
+	contents := []string{testutil.RandStr(), testutil.RandStr(), testutil.RandStr()}
+	now := time.Now()
+	expire := time.Now().Add(1 * time.Minute)
+
+	ee, err := testBackend.NewEvents(NewTS(now), NewTS(expire), contents)
+	require.Nil(t, err)
+	require.Nil(t, testBackend.SetEvents(ee, 0))
+
+	// Include an ID which was never set, it should be ignored
+	missing, err := testBackend.NewEvent(NewTS(now), NewTS(expire), "")
+	require.Nil(t, err)
+
+	require.Nil(t, testBackend.DelEvents([]ID{ee[0].ID, ee[2].ID, missing.ID}))
+	ee2, err := testBackend.GetEvents([]ID{ee[0].ID, ee[1].ID, ee[2].ID})
+	require.Nil(t, err)
+	assert.Equal(t, []Event{ee[1]}, ee2)
+
+	assert.Nil(t, testBackend.DelEvents(nil))
+}
+
 func TestKeyString(t *T) {
+	prefix := testutil.RandStr()
 	kk := []Key{
 		{Base: testutil.RandStr(), Subs: nil},
 		{Base: testutil.RandStr(), Subs: []string{testutil.RandStr()}},
@@ -159,7 +290,7 @@ func TestKeyString(t *T) {
 	}
 
 	for _, k := range kk {
-		str := k.String(testCore.o.RedisPrefix)
+		str := k.String(prefix)
 		assert.Equal(t, k, KeyFromString(str), "key:%q", str)
 	}
 }
@@ -169,7 +300,7 @@ func TestQueryBasicAddRemove(t *T) {
 	k, ii := randPopulatedKey(t, base, 3)
 	assertKey(t, k, ii...)
 
-	_, err := testCore.Query(QueryActions{
+	_, err := testBackend.Query(QueryActions{
 		KeyBase: k.Base,
 		QueryActions: []QueryAction{
 			{
@@ -203,7 +334,7 @@ func TestQueryAddScores(t *T) {
 	ii[1].Expire = NewTS(time.Now().Add(-1 * time.Second))
 	ii[3].Expire = NewTS(time.Now().Add(-1 * time.Second))
 
-	res, err := testCore.Query(QueryActions{
+	res, err := testBackend.Query(QueryActions{
 		KeyBase: base,
 		QueryActions: []QueryAction{
 			{
@@ -248,6 +379,29 @@ func TestQueryAddScores(t *T) {
 		ii[2]: 5,
 		ii[3]: 5,
 	})
+
+	_, err = testBackend.Query(QueryActions{
+		KeyBase: base,
+		QueryActions: []QueryAction{
+			{
+				QuerySelector: &QuerySelector{IDs: ii[2:]},
+			},
+			{
+				QueryAddTo: &QueryAddTo{
+					Keys:  []Key{k3},
+					Score: 2,
+					Incr:  true,
+				},
+			},
+		},
+	})
+	require.Nil(t, err)
+	assertKeyRaw(t, k3, map[ID]int64{
+		ii[0]: 5,
+		ii[1]: 5,
+		ii[2]: 7,
+		ii[3]: 7,
+	})
 }
 
 func TestQueryRemoveByScore(t *T) {
@@ -255,7 +409,7 @@ func TestQueryRemoveByScore(t *T) {
 	// QueryScoreRange, which is tested in TestQueryRangeSelect extensively
 	base := testutil.RandStr()
 	k, ii := randPopulatedKey(t, base, 4)
-	res, err := testCore.Query(QueryActions{
+	res, err := testBackend.Query(QueryActions{
 		KeyBase: k.Base,
 		QueryActions: []QueryAction{
 			{
@@ -278,7 +432,7 @@ func TestQueryRangeSelect(t *T) {
 	base := testutil.RandStr()
 	k, ii := randPopulatedKey(t, base, 4)
 
-	res, err := testCore.Query(QueryActions{
+	res, err := testBackend.Query(QueryActions{
 		KeyBase: k.Base,
 		QueryActions: []QueryAction{
 			{
@@ -297,7 +451,7 @@ func TestQueryRangeSelect(t *T) {
 	require.Nil(t, err)
 	assert.Equal(t, []ID{ii[1], ii[2]}, res.IDs)
 
-	res, err = testCore.Query(QueryActions{
+	res, err = testBackend.Query(QueryActions{
 		KeyBase: k.Base,
 		QueryActions: []QueryAction{
 			{
@@ -318,7 +472,7 @@ func TestQueryRangeSelect(t *T) {
 	require.Nil(t, err)
 	assert.Equal(t, []ID{ii[1], ii[2]}, res.IDs)
 
-	res, err = testCore.Query(QueryActions{
+	res, err = testBackend.Query(QueryActions{
 		KeyBase: k.Base,
 		QueryActions: []QueryAction{
 			{
@@ -339,7 +493,7 @@ func TestQueryRangeSelect(t *T) {
 	require.Nil(t, err)
 	assert.Equal(t, []ID{ii[1], ii[2]}, res.IDs)
 
-	res, err = testCore.Query(QueryActions{
+	res, err = testBackend.Query(QueryActions{
 		KeyBase: k.Base,
 		QueryActions: []QueryAction{
 			{
@@ -362,7 +516,7 @@ func TestQueryRangeSelect(t *T) {
 
 	minK := populatedKey(t, base, ii[0], ii[1])
 	maxK := populatedKey(t, base, ii[2], ii[3])
-	res, err = testCore.Query(QueryActions{
+	res, err = testBackend.Query(QueryActions{
 		KeyBase: k.Base,
 		QueryActions: []QueryAction{
 			{
@@ -386,7 +540,7 @@ func TestQueryRangeSelect(t *T) {
 	require.Nil(t, err)
 	assert.Equal(t, []ID{ii[1], ii[2], ii[3]}, res.IDs)
 
-	res, err = testCore.Query(QueryActions{
+	res, err = testBackend.Query(QueryActions{
 		KeyBase: k.Base,
 		QueryActions: []QueryAction{
 			{
@@ -415,7 +569,7 @@ func TestQueryIDScoreSelect(t *T) {
 	base := testutil.RandStr()
 	k, ii := randPopulatedKey(t, base, 1)
 
-	res, err := testCore.Query(QueryActions{
+	res, err := testBackend.Query(QueryActions{
 		KeyBase: k.Base,
 		QueryActions: []QueryAction{
 			{
@@ -431,7 +585,7 @@ func TestQueryIDScoreSelect(t *T) {
 	require.Nil(t, err)
 	assert.Equal(t, []ID{ii[0]}, res.IDs)
 
-	res, err = testCore.Query(QueryActions{
+	res, err = testBackend.Query(QueryActions{
 		KeyBase: k.Base,
 		QueryActions: []QueryAction{
 			{
@@ -448,7 +602,7 @@ func TestQueryIDScoreSelect(t *T) {
 	require.Nil(t, err)
 	assert.Equal(t, []ID{ii[0]}, res.IDs)
 
-	res, err = testCore.Query(QueryActions{
+	res, err = testBackend.Query(QueryActions{
 		KeyBase: k.Base,
 		QueryActions: []QueryAction{
 			{
@@ -471,7 +625,7 @@ func TestQueryPosRangeSelect(t *T) {
 	base := testutil.RandStr()
 	k, ii := randPopulatedKey(t, base, 4)
 
-	res, err := testCore.Query(QueryActions{
+	res, err := testBackend.Query(QueryActions{
 		KeyBase: k.Base,
 		QueryActions: []QueryAction{
 			{
@@ -486,6 +640,71 @@ func TestQueryPosRangeSelect(t *T) {
 	assert.Equal(t, []ID{ii[1], ii[2]}, res.IDs)
 }
 
+// Tests QueryExcessSelect and QueryTally
+func TestQueryExcessSelect(t *T) {
+	base := testutil.RandStr()
+	k, sk, tk := randKey(base), randKey(base), randKey(base)
+	ii := make([]ID, 4)
+	scores := []TS{3, 1, 2, 5}
+	for i := range ii {
+		ii[i] = requireNewID(t)
+		_, err := testBackend.Query(QueryActions{
+			KeyBase: base,
+			QueryActions: []QueryAction{
+				{QuerySelector: &QuerySelector{IDs: ii[i : i+1]}},
+				{QueryAddTo: &QueryAddTo{Keys: []Key{k}}},
+				{QueryAddTo: &QueryAddTo{Keys: []Key{sk}, Score: scores[i]}},
+				{QueryTally: &QueryTally{Key: sk, TotalKey: tk}},
+			},
+		})
+		require.Nil(t, err)
+	}
+
+	assertExcess := func(qes QueryExcessSelect, expected ...ID) {
+		qes.SumKey, qes.SumTotalKey = sk, tk
+		res, err := testBackend.Query(QueryActions{
+			KeyBase: base,
+			QueryActions: []QueryAction{
+				{
+					QuerySelector: &QuerySelector{
+						Key:               k,
+						QueryExcessSelect: &qes,
+					},
+				},
+			},
+		})
+		require.Nil(t, err)
+		if len(expected) == 0 {
+			expected = []ID{}
+		}
+		assert.Equal(t, expected, res.IDs, "qes:%#v", qes)
+	}
+
+	assertExcess(QueryExcessSelect{})
+	assertExcess(QueryExcessSelect{MaxCount: 4})
+	assertExcess(QueryExcessSelect{MaxCount: 2}, ii[0], ii[1])
+	assertExcess(QueryExcessSelect{MaxSum: 11})
+	assertExcess(QueryExcessSelect{MaxSum: 8}, ii[0])
+	assertExcess(QueryExcessSelect{MaxSum: 7}, ii[0], ii[1])
+	assertExcess(QueryExcessSelect{MaxSum: 4}, ii...)
+	assertExcess(QueryExcessSelect{MaxCount: 3, MaxSum: 7}, ii[0], ii[1])
+	assertExcess(QueryExcessSelect{MaxCount: 2, Keep: ii[1:2]}, ii[0], ii[2])
+	assertExcess(QueryExcessSelect{MaxSum: 8, Keep: ii[:1]}, ii[1], ii[2])
+
+	// Removing IDs from the tally brings the total down
+	_, err := testBackend.Query(QueryActions{
+		KeyBase: base,
+		QueryActions: []QueryAction{
+			{QuerySelector: &QuerySelector{IDs: ii[:1]}},
+			{QueryTally: &QueryTally{Key: sk, TotalKey: tk, Decr: true}},
+			{RemoveFrom: []Key{k, sk}},
+		},
+	})
+	require.Nil(t, err)
+	assertExcess(QueryExcessSelect{MaxSum: 8})
+	assertExcess(QueryExcessSelect{MaxSum: 7}, ii[1])
+}
+
 // Tests that expired IDs don't get returned when filtered. Also tests Invert
 func TestQueryFiltering(t *T) {
 	k := randKey(testutil.RandStr())
@@ -498,7 +717,7 @@ func TestQueryFiltering(t *T) {
 	ii[1].Expire = NewTS(time.Now().Add(-1 * time.Second))
 	ii[3].Expire = NewTS(time.Now().Add(-1 * time.Second))
 
-	res, err := testCore.Query(QueryActions{
+	res, err := testBackend.Query(QueryActions{
 		KeyBase: k.Base,
 		QueryActions: []QueryAction{
 			{
@@ -517,7 +736,7 @@ func TestQueryFiltering(t *T) {
 	require.Nil(t, err)
 	assert.Equal(t, []ID{ii[0], ii[2]}, res.IDs)
 
-	res, err = testCore.Query(QueryActions{
+	res, err = testBackend.Query(QueryActions{
 		KeyBase: k.Base,
 		QueryActions: []QueryAction{
 			{
@@ -536,6 +755,72 @@ func TestQueryFiltering(t *T) {
 	})
 	require.Nil(t, err)
 	assert.Equal(t, []ID{ii[1], ii[3]}, res.IDs)
+
+	// ii[3] is left out of scoreK completely
+	scoreK := randKey(k.Base)
+	for i, score := range []TS{1, 3, 5} {
+		_, err := testBackend.Query(QueryActions{
+			KeyBase: k.Base,
+			QueryActions: []QueryAction{
+				{
+					QuerySelector: &QuerySelector{IDs: ii[i : i+1]},
+				},
+				{
+					QueryAddTo: &QueryAddTo{
+						Keys:  []Key{scoreK},
+						Score: score,
+					},
+				},
+			},
+		})
+		require.Nil(t, err)
+	}
+
+	res, err = testBackend.Query(QueryActions{
+		KeyBase: k.Base,
+		QueryActions: []QueryAction{
+			{
+				QuerySelector: &QuerySelector{
+					Key: k,
+					IDs: ii,
+				},
+			},
+			{
+				QueryFilter: &QueryFilter{
+					InKey: &scoreK,
+					ScoreRange: QueryScoreRange{
+						Min: 3,
+					},
+				},
+			},
+		},
+	})
+	require.Nil(t, err)
+	assert.Equal(t, []ID{ii[0], ii[3]}, res.IDs)
+
+	res, err = testBackend.Query(QueryActions{
+		KeyBase: k.Base,
+		QueryActions: []QueryAction{
+			{
+				QuerySelector: &QuerySelector{
+					Key: k,
+					IDs: ii,
+				},
+			},
+			{
+				QueryFilter: &QueryFilter{
+					InKey: &scoreK,
+					ScoreRange: QueryScoreRange{
+						Min:     3,
+						MinExcl: true,
+					},
+					Invert: true,
+				},
+			},
+		},
+	})
+	require.Nil(t, err)
+	assert.Equal(t, []ID{ii[2]}, res.IDs)
 }
 
 func TestQueryIDs(t *T) {
@@ -548,7 +833,7 @@ func TestQueryIDs(t *T) {
 		requireNewID(t),
 	}
 
-	res, err := testCore.Query(QueryActions{
+	res, err := testBackend.Query(QueryActions{
 		KeyBase: k.Base,
 		QueryActions: []QueryAction{
 			{
@@ -567,7 +852,7 @@ func TestQueryIDs(t *T) {
 func TestQueryEmpty(t *T) {
 	base := testutil.RandStr()
 	k := randKey(base)
-	res, err := testCore.Query(QueryActions{
+	res, err := testBackend.Query(QueryActions{
 		KeyBase: k.Base,
 		QueryActions: []QueryAction{
 			{
@@ -603,7 +888,7 @@ func TestQueryUnion(t *T) {
 	assert.True(t, iiU[1].T < iiU[2].T)
 
 	// First test that previous output is overwritten without Union
-	res, err := testCore.Query(QueryActions{
+	res, err := testBackend.Query(QueryActions{
 		KeyBase: k.Base,
 		QueryActions: []QueryAction{
 			{
@@ -623,7 +908,7 @@ func TestQueryUnion(t *T) {
 	require.Nil(t, err)
 	assert.Equal(t, iiB, res.IDs)
 
-	res, err = testCore.Query(QueryActions{
+	res, err = testBackend.Query(QueryActions{
 		KeyBase: k.Base,
 		QueryActions: []QueryAction{
 			{
@@ -651,7 +936,7 @@ func TestQueryBreak(t *T) {
 	iiA := []ID{requireNewID(t)}
 	iiB := []ID{requireNewID(t)}
 
-	res, err := testCore.Query(QueryActions{
+	res, err := testBackend.Query(QueryActions{
 		KeyBase: k.Base,
 		QueryActions: []QueryAction{
 			{
@@ -674,7 +959,7 @@ func TestQueryBreak(t *T) {
 	require.Nil(t, err)
 	assert.Equal(t, iiA, res.IDs)
 
-	res, err = testCore.Query(QueryActions{
+	res, err = testBackend.Query(QueryActions{
 		KeyBase: k.Base,
 		QueryActions: []QueryAction{
 			{
@@ -705,7 +990,7 @@ func TestQueryConditionals(t *T) {
 	keyEmpty := randKey(base)
 	id := requireNewID(t)
 
-	res, err := testCore.Query(QueryActions{
+	res, err := testBackend.Query(QueryActions{
 		KeyBase: base,
 		QueryActions: []QueryAction{
 			{
@@ -721,7 +1006,7 @@ func TestQueryConditionals(t *T) {
 	require.Nil(t, err)
 	assert.Equal(t, id, res.IDs[0])
 
-	res, err = testCore.Query(QueryActions{
+	res, err = testBackend.Query(QueryActions{
 		KeyBase: base,
 		QueryActions: []QueryAction{
 			{
@@ -737,7 +1022,7 @@ func TestQueryConditionals(t *T) {
 	require.Nil(t, err)
 	assert.Empty(t, res.IDs)
 
-	res, err = testCore.Query(QueryActions{
+	res, err = testBackend.Query(QueryActions{
 		KeyBase: base,
 		QueryActions: []QueryAction{
 			{
@@ -760,7 +1045,7 @@ func TestQueryConditionals(t *T) {
 	require.Nil(t, err)
 	assert.Equal(t, id, res.IDs[0])
 
-	res, err = testCore.Query(QueryActions{
+	res, err = testBackend.Query(QueryActions{
 		KeyBase: base,
 		QueryActions: []QueryAction{
 			{
@@ -791,7 +1076,7 @@ func TestQueryCount(t *T) {
 	qsr := QueryScoreRange{}
 
 	assertCounts := func(a, b uint64) {
-		res, err := testCore.Query(QueryActions{
+		res, err := testBackend.Query(QueryActions{
 			KeyBase: base,
 			QueryActions: []QueryAction{
 				{
@@ -820,7 +1105,7 @@ func TestQueryCount(t *T) {
 	qsr.MaxExcl = true
 	assertCounts(3, 0)
 
-	res, err := testCore.Query(QueryActions{
+	res, err := testBackend.Query(QueryActions{
 		KeyBase: base,
 		QueryActions: []QueryAction{
 			{
@@ -841,6 +1126,34 @@ func TestQueryCount(t *T) {
 	assert.Equal(t, uint64(3), res.Counts[0])
 }
 
+func TestQueryLimitInput(t *T) {
+	base := testutil.RandStr()
+	k, ii := randPopulatedKey(t, base, 4)
+
+	assertLimit := func(limit int64, expected ...ID) {
+		res, err := testBackend.Query(QueryActions{
+			KeyBase: base,
+			QueryActions: []QueryAction{
+				{
+					QuerySelector: &QuerySelector{
+						Key:              k,
+						QueryRangeSelect: &QueryRangeSelect{},
+					},
+				},
+				{
+					LimitInput: limit,
+				},
+			},
+		})
+		require.Nil(t, err)
+		assert.Equal(t, expected, res.IDs)
+	}
+
+	assertLimit(1, ii[0])
+	assertLimit(3, ii[0], ii[1], ii[2])
+	assertLimit(10, ii...)
+}
+
 func TestKeyScan(t *T) {
 	base1 := testutil.RandStr()
 	base2 := testutil.RandStr()
@@ -850,10 +1163,10 @@ func TestKeyScan(t *T) {
 	k22, _ := randPopulatedKey(t, base2, 1)
 
 	assertScan := func(pattern Key, kk ...Key) {
-		found, err := testCore.KeyScan(pattern)
+		found, err := testBackend.KeyScan(pattern)
 		require.Nil(t, err)
 		for _, k := range found {
-			assert.Contains(t, kk, k, "k.String():%q", k.String(testCore.o.RedisPrefix))
+			assert.Contains(t, kk, k, "k.String():%q", k.String(""))
 		}
 	}
 
@@ -868,7 +1181,7 @@ func TestSingleGetSet(t *T) {
 	id := requireNewID(t)
 
 	// Setting returns the ID
-	res, err := testCore.Query(QueryActions{
+	res, err := testBackend.Query(QueryActions{
 		KeyBase: key.Base,
 		QueryActions: []QueryAction{
 			{
@@ -887,7 +1200,7 @@ func TestSingleGetSet(t *T) {
 	assert.Equal(t, id, res.IDs[0])
 
 	// Getting a set ID returns it
-	res, err = testCore.Query(QueryActions{
+	res, err = testBackend.Query(QueryActions{
 		KeyBase: key.Base,
 		QueryActions: []QueryAction{
 			{
@@ -899,7 +1212,7 @@ func TestSingleGetSet(t *T) {
 	assert.Equal(t, id, res.IDs[0])
 
 	// Getting a set ID after the expire doesn't return it
-	res, err = testCore.Query(QueryActions{
+	res, err = testBackend.Query(QueryActions{
 		Now:     id.Expire + 1,
 		KeyBase: key.Base,
 		QueryActions: []QueryAction{
@@ -914,7 +1227,7 @@ func TestSingleGetSet(t *T) {
 	// Trying to put an older ID with IfNewer results in no change
 	id2 := id
 	id2.T -= 5
-	res, err = testCore.Query(QueryActions{
+	res, err = testBackend.Query(QueryActions{
 		KeyBase: key.Base,
 		QueryActions: []QueryAction{
 			{
@@ -933,7 +1246,7 @@ func TestSingleGetSet(t *T) {
 	require.Nil(t, err)
 	assert.Equal(t, id2, res.IDs[0])
 
-	res, err = testCore.Query(QueryActions{
+	res, err = testBackend.Query(QueryActions{
 		KeyBase: key.Base,
 		QueryActions: []QueryAction{
 			{
@@ -944,8 +1257,72 @@ func TestSingleGetSet(t *T) {
 	require.Nil(t, err)
 	assert.Equal(t, id, res.IDs[0])
 
+	// Setting with Newest uses the last ID in the input
+	id3 := requireNewID(t)
+	id4 := requireNewID(t)
+	_, err = testBackend.Query(QueryActions{
+		KeyBase: key.Base,
+		QueryActions: []QueryAction{
+			{
+				QuerySelector: &QuerySelector{
+					IDs: []ID{id3, id4},
+				},
+			},
+			{
+				QuerySingleSet: &QuerySingleSet{
+					Key:     key,
+					IfNewer: true,
+					Newest:  true,
+				},
+			},
+		},
+	})
+	require.Nil(t, err)
+
+	res, err = testBackend.Query(QueryActions{
+		KeyBase: key.Base,
+		QueryActions: []QueryAction{
+			{
+				SingleGet: &key,
+			},
+		},
+	})
+	require.Nil(t, err)
+	assert.Equal(t, id4, res.IDs[0])
+
+	// Setting with ExpireAt causes the key to expire
+	_, err = testBackend.Query(QueryActions{
+		KeyBase: key.Base,
+		QueryActions: []QueryAction{
+			{
+				QuerySelector: &QuerySelector{
+					IDs: []ID{id},
+				},
+			},
+			{
+				QuerySingleSet: &QuerySingleSet{
+					Key:      key,
+					ExpireAt: NewTS(time.Now().Add(1 * time.Minute)),
+				},
+			},
+		},
+	})
+	require.Nil(t, err)
+	if mem, ok := testBackend.(*Mem); ok {
+		mem.l.Lock()
+		expireAt := mem.singles[memKey(key)].expireAt
+		mem.l.Unlock()
+		// ExpireAt is rounded up to the millisecond, like in redis
+		ttl := expireAt.Time().Sub(time.Now())
+		assert.True(t, ttl > 0 && ttl <= time.Minute+time.Millisecond, "ttl:%v", ttl)
+	} else {
+		pttl, err := testCore.c.Cmd("PTTL", key.String(testCore.o.RedisPrefix)).Int()
+		require.Nil(t, err)
+		assert.True(t, pttl > 0 && pttl <= 60000, "pttl:%d", pttl)
+	}
+
 	// Make sure delete works, here works as well as anywhere to test it
-	res, err = testCore.Query(QueryActions{
+	res, err = testBackend.Query(QueryActions{
 		KeyBase: key.Base,
 		QueryActions: []QueryAction{
 			{
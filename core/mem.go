@@ -0,0 +1,717 @@
+package core
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mem implements the same methods as Core, but keeps all of its data in memory
+// within the process instead of in redis. Its Query method has the same
+// semantics as Core's (and therefore query.lua), which makes it useful for
+// running tests without a redis instance and for cross-checking the lua
+// implementation.
+//
+// There are some small differences from Core. Elements in a set which have the
+// same score are ordered by their IDs, rather than by their marshalled form as
+// in redis. And since nothing is shared outside the process, KeyNotify will
+// only wake up KeyWait calls on the same Mem.
+//
+// All methods on Mem are thread-safe.
+type Mem struct {
+	l        sync.Mutex
+	zsets    map[string]map[ID]TS
+	singles  map[string]memSingle
+	totals   map[string]int64
+	events   map[ID]memEvent
+	lastTS   TS
+	reserved map[TS]bool
+	waiters  map[string]map[chan struct{}]struct{}
+}
+
+type memSingle struct {
+	id       ID
+	expireAt TS // 0 means never
+}
+
+type memEvent struct {
+	e        Event
+	expireAt time.Time
+}
+
+// NewMem initializes a new, empty Mem instance
+func NewMem() *Mem {
+	return &Mem{
+		zsets:    map[string]map[ID]TS{},
+		singles:  map[string]memSingle{},
+		totals:   map[string]int64{},
+		events:   map[ID]memEvent{},
+		reserved: map[TS]bool{},
+		waiters:  map[string]map[chan struct{}]struct{}{},
+	}
+}
+
+// Run is only here to match Core, Mem has no background work to do. nil will be
+// written to the returned channel once stopCh is closed.
+func (m *Mem) Run(stopCh chan struct{}) chan error {
+	errCh := make(chan error, 1)
+	go func() {
+		<-stopCh
+		errCh <- nil
+	}()
+	return errCh
+}
+
+// memKey returns the string form of the Key used to index it within Mem
+func memKey(k Key) string {
+	return k.String("")
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// MonoTS has the same semantics as Core's MonoTS, though it is only unique
+// within this Mem.
+func (m *Mem) MonoTS(t TS) (TS, error) {
+	m.l.Lock()
+	defer m.l.Unlock()
+	return m.monoTS(t, 1), nil
+}
+
+// see Core's monoTS. Must be called with the lock held
+func (m *Mem) monoTS(t TS, n uint64) TS {
+	first := t
+	if m.lastTS >= t {
+		first = m.lastTS + 1
+	}
+
+	for ts := range m.reserved {
+		if ts < first {
+			delete(m.reserved, ts)
+		}
+	}
+	for i := TS(0); i < TS(n); {
+		if m.reserved[first+i] {
+			first = first + i + 1
+			i = 0
+		} else {
+			i++
+		}
+	}
+
+	m.lastTS = first + TS(n) - 1
+	return first
+}
+
+// ReserveTS has the same semantics as Core's ReserveTS
+func (m *Mem) ReserveTS(t TS) (TS, error) {
+	m.l.Lock()
+	defer m.l.Unlock()
+	if m.lastTS >= t {
+		return m.monoTS(t, 1), nil
+	}
+	for m.reserved[t] {
+		t++
+	}
+	m.reserved[t] = true
+	return t, nil
+}
+
+// NewEvent has the same semantics as Core's NewEvent
+func (m *Mem) NewEvent(now, expire TS, contents string) (Event, error) {
+	nowMono, err := m.MonoTS(now)
+	if err != nil {
+		return Event{}, err
+	}
+	return Event{
+		ID:       ID{nowMono, expire},
+		Contents: contents,
+	}, nil
+}
+
+// NewScheduledEvent has the same semantics as Core's NewScheduledEvent
+func (m *Mem) NewScheduledEvent(at, expire TS, contents string) (Event, error) {
+	atRes, err := m.ReserveTS(at)
+	if err != nil {
+		return Event{}, err
+	}
+	return Event{
+		ID:       ID{atRes, expire},
+		Contents: contents,
+	}, nil
+}
+
+// NewEvents has the same semantics as Core's NewEvents
+func (m *Mem) NewEvents(now, expire TS, contents []string) ([]Event, error) {
+	if len(contents) == 0 {
+		return []Event{}, nil
+	}
+
+	m.l.Lock()
+	first := m.monoTS(now, uint64(len(contents)))
+	m.l.Unlock()
+
+	ee := make([]Event, len(contents))
+	for i := range contents {
+		ee[i] = Event{
+			ID:       ID{first + TS(i), expire},
+			Contents: contents[i],
+		}
+	}
+	return ee, nil
+}
+
+// SetEvent has the same semantics as Core's SetEvent
+func (m *Mem) SetEvent(e Event, expireBuffer time.Duration) error {
+	return m.SetEvents([]Event{e}, expireBuffer)
+}
+
+// SetEvents has the same semantics as Core's SetEvents
+func (m *Mem) SetEvents(ee []Event, expireBuffer time.Duration) error {
+	m.l.Lock()
+	defer m.l.Unlock()
+	for _, e := range ee {
+		m.events[e.ID] = memEvent{
+			e:        e,
+			expireAt: e.ID.Expire.Time().Add(expireBuffer),
+		}
+	}
+	return nil
+}
+
+// GetEvent has the same semantics as Core's GetEvent
+func (m *Mem) GetEvent(id ID) (Event, error) {
+	m.l.Lock()
+	defer m.l.Unlock()
+	me, ok := m.events[id]
+	if !ok || !time.Now().Before(me.expireAt) {
+		return Event{}, ErrNotFound
+	}
+	return me.e, nil
+}
+
+// GetEvents has the same semantics as Core's GetEvents
+func (m *Mem) GetEvents(ii []ID) ([]Event, error) {
+	ee := make([]Event, 0, len(ii))
+	for _, id := range ii {
+		e, err := m.GetEvent(id)
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		ee = append(ee, e)
+	}
+	return ee, nil
+}
+
+// DelEvents has the same semantics as Core's DelEvents
+func (m *Mem) DelEvents(ii []ID) error {
+	m.l.Lock()
+	defer m.l.Unlock()
+	for _, id := range ii {
+		delete(m.events, id)
+	}
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// KeyWait has the same semantics as Core's KeyWait
+func (m *Mem) KeyWait(k Key, stopCh <-chan struct{}) <-chan struct{} {
+	key := memKey(k)
+	ch := make(chan struct{})
+
+	m.l.Lock()
+	if m.waiters[key] == nil {
+		m.waiters[key] = map[chan struct{}]struct{}{}
+	}
+	m.waiters[key][ch] = struct{}{}
+	m.l.Unlock()
+
+	retCh := make(chan struct{})
+	go func() {
+		select {
+		case <-ch:
+		case <-stopCh:
+		}
+		m.l.Lock()
+		delete(m.waiters[key], ch)
+		m.l.Unlock()
+		close(retCh)
+	}()
+
+	return retCh
+}
+
+// KeyNotify has the same semantics as Core's KeyNotify
+func (m *Mem) KeyNotify(k Key) {
+	key := memKey(k)
+	m.l.Lock()
+	defer m.l.Unlock()
+	for ch := range m.waiters[key] {
+		close(ch)
+	}
+	delete(m.waiters, key)
+}
+
+// KeyScan has the same semantics as Core's KeyScan
+func (m *Mem) KeyScan(k Key) ([]Key, error) {
+	pattern := memKey(k)
+
+	m.l.Lock()
+	defer m.l.Unlock()
+
+	var ret []Key
+	for key := range m.zsets {
+		if memGlob(pattern, key) {
+			ret = append(ret, KeyFromString(key))
+		}
+	}
+	for key := range m.singles {
+		if m.singleExists(key) && memGlob(pattern, key) {
+			ret = append(ret, KeyFromString(key))
+		}
+	}
+	for key := range m.totals {
+		if memGlob(pattern, key) {
+			ret = append(ret, KeyFromString(key))
+		}
+	}
+	return ret, nil
+}
+
+// memGlob returns whether the given string matches the given pattern, where
+// '*' in the pattern matches any number of any characters. This is the only
+// part of redis' pattern syntax which KeyScan makes use of.
+func memGlob(pattern, s string) bool {
+	pp := strings.Split(pattern, "*")
+	if len(pp) == 1 {
+		return pattern == s
+	}
+
+	if !strings.HasPrefix(s, pp[0]) {
+		return false
+	}
+	s = s[len(pp[0]):]
+
+	last := pp[len(pp)-1]
+	for _, p := range pp[1 : len(pp)-1] {
+		i := strings.Index(s, p)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(p):]
+	}
+	return len(s) >= len(last) && strings.HasSuffix(s, last)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Must be called with the lock held
+func (m *Mem) singleExists(key string) bool {
+	ms, ok := m.singles[key]
+	if !ok {
+		return false
+	}
+	if ms.expireAt > 0 && NewTS(time.Now()) >= ms.expireAt {
+		delete(m.singles, key)
+		return false
+	}
+	return true
+}
+
+// Must be called with the lock held
+func (m *Mem) exists(key string) bool {
+	return len(m.zsets[key]) > 0 || m.singleExists(key) || m.totals[key] != 0
+}
+
+// Must be called with the lock held
+func (m *Mem) zadd(key string, id ID, score TS, incr bool) {
+	z := m.zsets[key]
+	if z == nil {
+		z = map[ID]TS{}
+		m.zsets[key] = z
+	}
+	if incr {
+		score += z[id]
+	}
+	z[id] = score
+}
+
+// Must be called with the lock held
+func (m *Mem) zrem(key string, id ID) {
+	z := m.zsets[key]
+	delete(z, id)
+	if len(z) == 0 {
+		delete(m.zsets, key)
+	}
+}
+
+type memEntry struct {
+	id    ID
+	score TS
+}
+
+// Returns all elements in the given set whose score falls in the given range,
+// ordered by score. Must be called with the lock held
+func (m *Mem) zrange(key string, qsr QueryScoreRange) []memEntry {
+	var ee []memEntry
+	for id, score := range m.zsets[key] {
+		if scoreInRange(score, qsr) {
+			ee = append(ee, memEntry{id, score})
+		}
+	}
+	sort.Slice(ee, func(i, j int) bool {
+		if ee[i].score != ee[j].score {
+			return ee[i].score < ee[j].score
+		} else if ee[i].id.T != ee[j].id.T {
+			return ee[i].id.T < ee[j].id.T
+		}
+		return ee[i].id.Expire < ee[j].id.Expire
+	})
+	return ee
+}
+
+// returns whether or not the given score falls within the given score range.
+// MinFromInput and MaxFromInput are ignored
+func scoreInRange(score TS, qsr QueryScoreRange) bool {
+	if qsr.Min > 0 {
+		if score < qsr.Min || (qsr.MinExcl && score == qsr.Min) {
+			return false
+		}
+	}
+	if qsr.Max > 0 {
+		if score > qsr.Max || (qsr.MaxExcl && score == qsr.Max) {
+			return false
+		}
+	}
+	return true
+}
+
+// fills in Min/Max on the given range based on the input, if MinFromInput or
+// MaxFromInput are set
+func inputScoreRange(input []ID, qsr QueryScoreRange) QueryScoreRange {
+	if qsr.MinFromInput {
+		qsr.Min = 0
+		if len(input) > 0 {
+			qsr.Min = input[len(input)-1].T
+		}
+	}
+	if qsr.MaxFromInput {
+		qsr.Max = 0
+		if len(input) > 0 {
+			qsr.Max = input[0].T
+		}
+	}
+	return qsr
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Query has the same semantics as Core's Query
+func (m *Mem) Query(qas QueryActions) (QueryRes, error) {
+	if qas.Now == 0 {
+		qas.Now = NewTS(time.Now())
+	}
+
+	m.l.Lock()
+	defer m.l.Unlock()
+
+	var res QueryRes
+	ii := []ID{}
+	for _, qa := range qas.QueryActions {
+		newii, skipped := m.queryAction(&res, qas.Now, ii, qa)
+		if !skipped && qa.Break {
+			break
+		}
+
+		if qa.Union {
+			set := map[TS]ID{}
+			for _, id := range ii {
+				set[id.T] = id
+			}
+			for _, id := range newii {
+				set[id.T] = id
+			}
+			newii = make([]ID, 0, len(set))
+			for _, id := range set {
+				newii = append(newii, id)
+			}
+		}
+
+		// Like in query.lua, the output is always sorted by T
+		sort.SliceStable(newii, func(i, j int) bool {
+			return newii[i].T < newii[j].T
+		})
+		ii = newii
+	}
+
+	res.IDs = ii
+	return res, nil
+}
+
+// performs the QueryAction with the given input set. Returns the new input set,
+// and whether or not the action was skipped (which it might be if a conditional
+// stopped it from happening). Must be called with the lock held
+func (m *Mem) queryAction(res *QueryRes, now TS, input []ID, qa QueryAction) ([]ID, bool) {
+	if !m.queryConditional(input, qa.QueryConditional) {
+		return input, true
+	}
+
+	switch {
+	case qa.QuerySelector != nil:
+		return m.querySelect(input, qa.QuerySelector), false
+
+	case qa.QueryCount != nil:
+		qsr := inputScoreRange(input, qa.QueryCount.QueryScoreRange)
+		count := len(m.zrange(memKey(qa.QueryCount.Key), qsr))
+		res.Counts = append(res.Counts, uint64(count))
+		return input, false
+
+	case qa.CountInput:
+		res.Counts = append(res.Counts, uint64(len(input)))
+		return input, false
+
+	case qa.LimitInput > 0:
+		if int64(len(input)) > qa.LimitInput {
+			input = input[:qa.LimitInput]
+		}
+		return append([]ID{}, input...), false
+
+	case qa.QueryAddTo != nil:
+		qat := qa.QueryAddTo
+		for _, k := range qat.Keys {
+			for _, id := range input {
+				score := id.T
+				if qat.ExpireAsScore {
+					score = id.Expire
+				}
+				if qat.Score > 0 {
+					score = qat.Score
+				}
+				m.zadd(memKey(k), id, score, qat.Incr)
+			}
+		}
+		return input, false
+
+	case len(qa.RemoveFrom) > 0:
+		for _, k := range qa.RemoveFrom {
+			for _, id := range input {
+				m.zrem(memKey(k), id)
+			}
+		}
+		return input, false
+
+	case qa.QueryTally != nil:
+		qt := qa.QueryTally
+		z := m.zsets[memKey(qt.Key)]
+		var sum int64
+		for _, id := range input {
+			sum += int64(z[id])
+		}
+		if qt.Decr {
+			sum = -sum
+		}
+		// Like in query.lua, a total of zero doesn't leave a key behind
+		totalKey := memKey(qt.TotalKey)
+		m.totals[totalKey] += sum
+		if m.totals[totalKey] == 0 {
+			delete(m.totals, totalKey)
+		}
+		return input, false
+
+	case qa.QueryRemoveByScore != nil:
+		qrems := qa.QueryRemoveByScore
+		qsr := inputScoreRange(input, qrems.QueryScoreRange)
+		for _, k := range qrems.Keys {
+			key := memKey(k)
+			for _, e := range m.zrange(key, qsr) {
+				m.zrem(key, e.id)
+			}
+		}
+		return input, false
+
+	case qa.QuerySingleSet != nil:
+		qss := qa.QuerySingleSet
+		key := memKey(qss.Key)
+		if len(input) == 0 {
+			return input, false
+		}
+		id := input[0]
+		if qss.Newest {
+			id = input[len(input)-1]
+		}
+		if qss.IfNewer && m.singleExists(key) && m.singles[key].id.T > id.T {
+			return input, false
+		}
+		var expireAt TS
+		if qss.ExpireAt > 0 {
+			// redis only has millisecond precision on expires, and query.lua
+			// rounds up
+			expireAt = ((qss.ExpireAt + 999) / 1000) * 1000
+		}
+		delete(m.zsets, key)
+		delete(m.totals, key)
+		m.singles[key] = memSingle{id: id, expireAt: expireAt}
+		return input, false
+
+	case qa.SingleGet != nil:
+		key := memKey(*qa.SingleGet)
+		if !m.singleExists(key) {
+			return []ID{}, false
+		}
+		id := m.singles[key].id
+		if id.Expire < now {
+			return []ID{}, false
+		}
+		return []ID{id}, false
+
+	case qa.Delete != nil:
+		key := memKey(*qa.Delete)
+		delete(m.zsets, key)
+		delete(m.singles, key)
+		delete(m.totals, key)
+		return input, false
+
+	case qa.QueryFilter != nil:
+		return m.queryFilter(now, input, qa.QueryFilter), false
+	}
+
+	// Shouldn't really get here but whatever
+	return input, false
+}
+
+// Must be called with the lock held
+func (m *Mem) querySelect(input []ID, qs *QuerySelector) []ID {
+	key := memKey(qs.Key)
+	output := []ID{}
+
+	switch {
+	case qs.QueryRangeSelect != nil:
+		qrs := qs.QueryRangeSelect
+		qsr := inputScoreRange(input, qrs.QueryScoreRange)
+		ee := m.zrange(key, qsr)
+		if qrs.Reverse {
+			for i, j := 0, len(ee)-1; i < j; i, j = i+1, j-1 {
+				ee[i], ee[j] = ee[j], ee[i]
+			}
+		}
+		if qrs.Limit != 0 {
+			if qrs.Offset >= int64(len(ee)) {
+				ee = nil
+			} else {
+				ee = ee[qrs.Offset:]
+			}
+			if qrs.Limit > 0 && qrs.Limit < int64(len(ee)) {
+				ee = ee[:qrs.Limit]
+			}
+		}
+		for _, e := range ee {
+			output = append(output, e.id)
+		}
+
+	case qs.QueryIDScoreSelect != nil:
+		qiss := qs.QueryIDScoreSelect
+		score, ok := m.zsets[key][qiss.ID]
+		if !ok ||
+			score < qiss.Min ||
+			(qiss.Max > 0 && score > qiss.Max) ||
+			(qiss.Equal > 0 && score != qiss.Equal) {
+			break
+		}
+		output = append(output, qiss.ID)
+
+	case qs.QueryExcessSelect != nil:
+		qes := qs.QueryExcessSelect
+		ee := m.zrange(key, QueryScoreRange{})
+		count := int64(len(ee))
+		var sum int64
+		if qes.MaxSum > 0 {
+			sum = m.totals[memKey(qes.SumTotalKey)]
+		}
+		keep := map[ID]bool{}
+		for _, id := range qes.Keep {
+			keep[id] = true
+		}
+		for _, e := range ee {
+			if (qes.MaxCount == 0 || count <= qes.MaxCount) &&
+				(qes.MaxSum == 0 || sum <= qes.MaxSum) {
+				break
+			} else if keep[e.id] {
+				continue
+			}
+			output = append(output, e.id)
+			count--
+			if qes.MaxSum > 0 {
+				sum -= int64(m.zsets[memKey(qes.SumKey)][e.id])
+			}
+		}
+
+	case len(qs.PosRangeSelect) > 0:
+		ee := m.zrange(key, QueryScoreRange{})
+		l := int64(len(ee))
+		start, stop := qs.PosRangeSelect[0], qs.PosRangeSelect[1]
+		if start < 0 {
+			start += l
+		}
+		if stop < 0 {
+			stop += l
+		}
+		if start < 0 {
+			start = 0
+		}
+		if stop >= l {
+			stop = l - 1
+		}
+		for i := start; i <= stop; i++ {
+			output = append(output, ee[i].id)
+		}
+
+	default:
+		output = append(output, qs.IDs...)
+	}
+
+	return output
+}
+
+// Must be called with the lock held
+func (m *Mem) queryFilter(now TS, input []ID, qf *QueryFilter) []ID {
+	output := []ID{}
+	for _, id := range input {
+		var filter bool
+		if qf.Expired {
+			filter = id.Expire <= now
+		} else if qf.InKey != nil {
+			score, ok := m.zsets[memKey(*qf.InKey)][id]
+			filter = ok && scoreInRange(score, qf.ScoreRange)
+		}
+		if filter == qf.Invert {
+			output = append(output, id)
+		}
+	}
+	return output
+}
+
+// Returns true if the conditional succeeds, i.e. the QueryAction should be
+// performed. Must be called with the lock held
+func (m *Mem) queryConditional(input []ID, qc QueryConditional) bool {
+	for _, and := range qc.And {
+		if !m.queryConditional(input, and) {
+			return false
+		}
+	}
+	if qc.IfNoInput && len(input) > 0 {
+		return false
+	}
+	if qc.IfInput && len(input) == 0 {
+		return false
+	}
+	if qc.IfEmpty != nil && m.exists(memKey(*qc.IfEmpty)) {
+		return false
+	}
+	if qc.IfNotEmpty != nil && !m.exists(memKey(*qc.IfNotEmpty)) {
+		return false
+	}
+	return true
+}
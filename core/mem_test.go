@@ -0,0 +1,271 @@
+package core
+
+import (
+	"sort"
+	. "testing"
+	"time"
+
+	"github.com/levenlabs/golib/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Performs the given query against the given Mem and asserts that its result is
+// the expected one. If testCore is available the query is performed against it
+// as well, and it's asserted to give back the same result
+func assertMemQuery(t *T, m *Mem, qas QueryActions, expected QueryRes) {
+	if expected.IDs == nil {
+		expected.IDs = []ID{}
+	}
+	normCounts := func(res *QueryRes) {
+		if len(res.Counts) == 0 {
+			res.Counts = nil
+		}
+	}
+	normCounts(&expected)
+
+	qas.Now = NewTS(time.Now())
+	mres, err := m.Query(qas)
+	require.Nil(t, err)
+	normCounts(&mres)
+	assert.Equal(t, expected, mres, "qas:%#v", qas)
+
+	if testCore == nil {
+		return
+	}
+	res, err := testCore.Query(qas)
+	require.Nil(t, err)
+	normCounts(&res)
+	assert.Equal(t, expected, res, "qas:%#v", qas)
+}
+
+func TestMemQuery(t *T) {
+	m := NewMem()
+	base := testutil.RandStr()
+	k1, k2, k3, k4, k5 := randKey(base), randKey(base), randKey(base), randKey(base), randKey(base)
+	k6 := randKey(base)
+
+	ii := make([]ID, 5)
+	for i := range ii {
+		ts, err := m.MonoTS(NewTS(time.Now()))
+		require.Nil(t, err)
+		ii[i] = ID{T: ts, Expire: NewTS(ts.Time().Add(1 * time.Minute))}
+	}
+	expiredTS, err := m.MonoTS(NewTS(time.Now()))
+	require.Nil(t, err)
+	expired := ID{T: expiredTS, Expire: NewTS(time.Now().Add(-1 * time.Minute))}
+
+	rangeSel := func(k Key, qsr QueryScoreRange) QueryAction {
+		return QueryAction{
+			QuerySelector: &QuerySelector{
+				Key:              k,
+				QueryRangeSelect: &QueryRangeSelect{QueryScoreRange: qsr},
+			},
+		}
+	}
+	idsSel := func(ii ...ID) QueryAction {
+		return QueryAction{QuerySelector: &QuerySelector{IDs: ii}}
+	}
+	ids := func(ii ...ID) QueryRes {
+		return QueryRes{IDs: ii}
+	}
+
+	pipelines := []struct {
+		qq       []QueryAction
+		expected QueryRes
+	}{
+		// Populating
+		{[]QueryAction{idsSel(ii...), {QueryAddTo: &QueryAddTo{Keys: []Key{k1}}}}, ids(ii...)},
+		{[]QueryAction{idsSel(ii[1], ii[2]), {QueryAddTo: &QueryAddTo{Keys: []Key{k2}, ExpireAsScore: true}}}, ids(ii[1], ii[2])},
+		{[]QueryAction{idsSel(ii[0], ii[3]), {QueryAddTo: &QueryAddTo{Keys: []Key{k3}, Score: 5, Incr: true}}}, ids(ii[0], ii[3])},
+		{[]QueryAction{idsSel(ii[3], ii[4]), {QueryAddTo: &QueryAddTo{Keys: []Key{k3}, Score: 1, Incr: true}}}, ids(ii[3], ii[4])},
+		{[]QueryAction{idsSel(ii...), {QueryTally: &QueryTally{Key: k3, TotalKey: k6}}}, ids(ii...)},
+
+		// Selectors
+		{[]QueryAction{rangeSel(k1, QueryScoreRange{})}, ids(ii...)},
+		{[]QueryAction{rangeSel(k1, QueryScoreRange{Min: ii[1].T, MinExcl: true, Max: ii[3].T})}, ids(ii[2], ii[3])},
+		{[]QueryAction{rangeSel(k3, QueryScoreRange{Min: 5})}, ids(ii[0], ii[3])},
+		{[]QueryAction{{QuerySelector: &QuerySelector{
+			Key: k1,
+			QueryRangeSelect: &QueryRangeSelect{
+				Reverse: true,
+				Limit:   2,
+				Offset:  1,
+			},
+		}}}, ids(ii[2], ii[3])},
+		{[]QueryAction{{QuerySelector: &QuerySelector{
+			Key: k1,
+			QueryRangeSelect: &QueryRangeSelect{
+				Limit:  -1,
+				Offset: 3,
+			},
+		}}}, ids(ii[3], ii[4])},
+		{[]QueryAction{idsSel(ii[2]), rangeSel(k1, QueryScoreRange{MinFromInput: true, MinExcl: true})}, ids(ii[3], ii[4])},
+		{[]QueryAction{idsSel(ii[2]), rangeSel(k1, QueryScoreRange{MaxFromInput: true})}, ids(ii[0], ii[1], ii[2])},
+		{[]QueryAction{{QuerySelector: &QuerySelector{Key: k1, QueryIDScoreSelect: &QueryIDScoreSelect{ID: ii[2], Min: ii[2].T}}}}, ids(ii[2])},
+		{[]QueryAction{{QuerySelector: &QuerySelector{Key: k1, QueryIDScoreSelect: &QueryIDScoreSelect{ID: ii[2], Min: ii[3].T}}}}, ids()},
+		{[]QueryAction{{QuerySelector: &QuerySelector{Key: k3, QueryIDScoreSelect: &QueryIDScoreSelect{ID: ii[3], Equal: 6}}}}, ids(ii[3])},
+		{[]QueryAction{{QuerySelector: &QuerySelector{Key: k1, PosRangeSelect: []int64{1, -2}}}}, ids(ii[1], ii[2], ii[3])},
+		{[]QueryAction{{QuerySelector: &QuerySelector{Key: k1, PosRangeSelect: []int64{-1, 10}}}}, ids(ii[4])},
+		{[]QueryAction{{QuerySelector: &QuerySelector{Key: k1, QueryExcessSelect: &QueryExcessSelect{MaxCount: 2}}}}, ids(ii[0], ii[1], ii[2])},
+		{[]QueryAction{{QuerySelector: &QuerySelector{Key: k1, QueryExcessSelect: &QueryExcessSelect{MaxCount: 2, Keep: ii[:2]}}}}, ids(ii[2], ii[3], ii[4])},
+		{[]QueryAction{{QuerySelector: &QuerySelector{Key: k1, QueryExcessSelect: &QueryExcessSelect{MaxSum: 6, SumKey: k3, SumTotalKey: k6}}}}, ids(ii[0], ii[1], ii[2], ii[3])},
+		{[]QueryAction{{QuerySelector: &QuerySelector{Key: k1, QueryExcessSelect: &QueryExcessSelect{MaxCount: 4, MaxSum: 11, SumKey: k3, SumTotalKey: k6}}}}, ids(ii[0])},
+		{[]QueryAction{idsSel(ii[4], expired, ii[0])}, ids(ii[0], ii[4], expired)},
+
+		// Counting and limiting
+		{
+			[]QueryAction{
+				idsSel(ii[1]),
+				{QueryCount: &QueryCount{Key: k1, QueryScoreRange: QueryScoreRange{MinFromInput: true, MinExcl: true}}},
+				{QueryCount: &QueryCount{Key: k2}},
+				rangeSel(k1, QueryScoreRange{}),
+				{CountInput: true},
+				{LimitInput: 2},
+				{CountInput: true},
+			},
+			QueryRes{IDs: []ID{ii[0], ii[1]}, Counts: []uint64{3, 2, 5, 2}},
+		},
+
+		// Filtering
+		{[]QueryAction{idsSel(ii[0], expired), {QueryFilter: &QueryFilter{Expired: true}}}, ids(ii[0])},
+		{[]QueryAction{idsSel(ii[0], expired), {QueryFilter: &QueryFilter{Expired: true, Invert: true}}}, ids(expired)},
+		{[]QueryAction{rangeSel(k1, QueryScoreRange{}), {QueryFilter: &QueryFilter{InKey: &k2}}}, ids(ii[0], ii[3], ii[4])},
+		{[]QueryAction{rangeSel(k1, QueryScoreRange{}), {QueryFilter: &QueryFilter{InKey: &k3, ScoreRange: QueryScoreRange{Min: 5}, Invert: true}}}, ids(ii[0], ii[3])},
+
+		// Conditionals, Break and Union
+		{[]QueryAction{idsSel(ii[0]), {QueryConditional: QueryConditional{IfEmpty: &k5}, QuerySelector: &QuerySelector{IDs: ii[1:2]}}}, ids(ii[1])},
+		{[]QueryAction{idsSel(ii[0]), {QueryConditional: QueryConditional{IfNotEmpty: &k5}, QuerySelector: &QuerySelector{IDs: ii[1:2]}}}, ids(ii[0])},
+		{[]QueryAction{idsSel(), {QueryConditional: QueryConditional{IfNoInput: true}, QuerySelector: &QuerySelector{IDs: ii[1:2]}}}, ids(ii[1])},
+		{[]QueryAction{idsSel(ii[0]), {
+			QueryConditional: QueryConditional{And: []QueryConditional{
+				{IfInput: true},
+				{IfNotEmpty: &k1},
+				{IfEmpty: &k2},
+			}},
+			QuerySelector: &QuerySelector{IDs: ii[1:2]},
+		}}, ids(ii[0])},
+		{[]QueryAction{idsSel(ii[0]), {Break: true, QueryConditional: QueryConditional{IfInput: true}}, idsSel(ii[1])}, ids(ii[0])},
+		{[]QueryAction{idsSel(), {Break: true, QueryConditional: QueryConditional{IfInput: true}}, idsSel(ii[1])}, ids(ii[1])},
+		{[]QueryAction{rangeSel(k2, QueryScoreRange{}), {Union: true, QuerySelector: &QuerySelector{Key: k3, QueryRangeSelect: &QueryRangeSelect{}}}}, ids(ii...)},
+
+		// Single keys
+		{[]QueryAction{{SingleGet: &k4}}, ids()},
+		{[]QueryAction{idsSel(ii[1], ii[2]), {QuerySingleSet: &QuerySingleSet{Key: k4}}, {SingleGet: &k4}}, ids(ii[1])},
+		{[]QueryAction{idsSel(ii[0]), {QuerySingleSet: &QuerySingleSet{Key: k4, IfNewer: true}}, {SingleGet: &k4}}, ids(ii[1])},
+		{[]QueryAction{idsSel(ii[3], ii[4]), {QuerySingleSet: &QuerySingleSet{Key: k4, IfNewer: true, Newest: true}}, {SingleGet: &k4}}, ids(ii[4])},
+		{[]QueryAction{idsSel(expired), {QuerySingleSet: &QuerySingleSet{Key: k5}}, {SingleGet: &k5}}, ids()},
+		{[]QueryAction{idsSel(ii[0]), {QueryConditional: QueryConditional{IfNotEmpty: &k5}, QuerySelector: &QuerySelector{IDs: ii[1:2]}}}, ids(ii[1])},
+
+		// Removing
+		{[]QueryAction{idsSel(ii[0]), {QueryTally: &QueryTally{Key: k3, TotalKey: k6, Decr: true}}, {RemoveFrom: []Key{k1, k3}}}, ids(ii[0])},
+		{[]QueryAction{{QuerySelector: &QuerySelector{Key: k1, QueryExcessSelect: &QueryExcessSelect{MaxSum: 6, SumKey: k3, SumTotalKey: k6}}}}, ids(ii[1], ii[2], ii[3])},
+		{[]QueryAction{idsSel(ii[4]), {QueryRemoveByScore: &QueryRemoveByScore{Keys: []Key{k1}, QueryScoreRange: QueryScoreRange{MinFromInput: true}}}}, ids(ii[4])},
+		{[]QueryAction{{Delete: &k2}, rangeSel(k2, QueryScoreRange{})}, ids()},
+		{[]QueryAction{{Delete: &k5}, {SingleGet: &k5}}, ids()},
+	}
+
+	for _, p := range pipelines {
+		assertMemQuery(t, m, QueryActions{KeyBase: base, QueryActions: p.qq}, p.expected)
+	}
+
+	// Make sure all the keys ended up with the expected contents, and that the
+	// expected keys exist
+	for k, expected := range map[*Key]QueryRes{
+		&k1: ids(ii[1], ii[2], ii[3]),
+		&k2: ids(),
+		&k3: ids(ii[3], ii[4]),
+	} {
+		assertMemQuery(t, m, QueryActions{
+			KeyBase:      base,
+			QueryActions: []QueryAction{rangeSel(*k, QueryScoreRange{})},
+		}, expected)
+	}
+
+	sortKeys := func(kk []Key) {
+		sort.Slice(kk, func(i, j int) bool { return kk[i].String("") < kk[j].String("") })
+	}
+	scanKey := Key{Base: base, Subs: []string{"*"}}
+	expectedKK := []Key{k1, k3, k4, k6}
+	sortKeys(expectedKK)
+	mkk, err := m.KeyScan(scanKey)
+	require.Nil(t, err)
+	sortKeys(mkk)
+	assert.Equal(t, expectedKK, mkk)
+
+	if testCore == nil {
+		return
+	}
+	kk, err := testCore.KeyScan(scanKey)
+	require.Nil(t, err)
+	sortKeys(kk)
+	assert.Equal(t, expectedKK, kk)
+}
+
+func TestMemEvents(t *T) {
+	m := NewMem()
+	now := NewTS(time.Now())
+	expire := NewTS(time.Now().Add(1 * time.Minute))
+
+	ee, err := m.NewEvents(now, expire, []string{testutil.RandStr(), testutil.RandStr()})
+	require.Nil(t, err)
+	require.Len(t, ee, 2)
+	assert.True(t, ee[1].ID.T > ee[0].ID.T)
+
+	e, err := m.NewEvent(now, expire, testutil.RandStr())
+	require.Nil(t, err)
+	assert.True(t, e.ID.T > ee[1].ID.T)
+
+	// An event which expired some time ago, and whose buffer has passed as
+	// well
+	eExp, err := m.NewEvent(now, NewTS(time.Now().Add(-1*time.Minute)), "")
+	require.Nil(t, err)
+
+	require.Nil(t, m.SetEvents(append(ee, e, eExp), 1*time.Second))
+	ee2, err := m.GetEvents([]ID{ee[0].ID, ee[1].ID, e.ID, eExp.ID})
+	require.Nil(t, err)
+	assert.Equal(t, append(ee, e), ee2)
+
+	require.Nil(t, m.DelEvents([]ID{ee[0].ID}))
+	_, err = m.GetEvent(ee[0].ID)
+	assert.Equal(t, ErrNotFound, err)
+
+	// Reserved TSs are skipped by MonoTS, like with Core
+	future := NewTS(time.Now().Add(1 * time.Hour))
+	rTS, err := m.ReserveTS(future)
+	require.Nil(t, err)
+	assert.Equal(t, future, rTS)
+	mTS, err := m.MonoTS(future)
+	require.Nil(t, err)
+	assert.Equal(t, future+1, mTS)
+}
+
+func TestMemKeyWait(t *T) {
+	m := NewMem()
+	base := testutil.RandStr()
+	k1, k2 := randKey(base), randKey(base)
+
+	ch1 := m.KeyWait(k1, nil)
+	stopCh := make(chan struct{})
+	ch2 := m.KeyWait(k2, stopCh)
+
+	m.KeyNotify(k1)
+	select {
+	case <-ch1:
+	case <-time.After(1 * time.Second):
+		t.Fatal("k1 waiter not notified")
+	}
+
+	select {
+	case <-ch2:
+		t.Fatal("k2 waiter notified")
+	default:
+	}
+
+	close(stopCh)
+	select {
+	case <-ch2:
+	case <-time.After(1 * time.Second):
+		t.Fatal("k2 waiter not stopped")
+	}
+}
@@ -9,6 +9,7 @@ import (
 )
 
 func TestKeyWait(t *T) {
+	requireRedis(t)
 	// Make sure notifying on Keys which don't have waiters is fine
 	base := testutil.RandStr()
 	k1 := randKey(base)
@@ -62,6 +62,18 @@ local function query_score_range(input, qsr)
     return min, max
 end
 
+-- returns whether or not the given score falls within the given score range.
+-- MinFromInput and MaxFromInput are ignored
+local function score_in_range(score, qsr)
+    if qsr.Min > 0 then
+        if score < qsr.Min or (qsr.MinExcl and score == qsr.Min) then return false end
+    end
+    if qsr.Max > 0 then
+        if score > qsr.Max or (qsr.MaxExcl and score == qsr.Max) then return false end
+    end
+    return true
+end
+
 -- predefined this because it and query_select_inner call each other recursively
 local query_select
 
@@ -101,6 +113,46 @@ local function query_select_inner(input, qs)
         if qiss.Equal > 0 and score ~= qiss.Equal then return {} end
         return {id}
 
+    elseif qs.QueryExcessSelect then
+        local qes = qs.QueryExcessSelect
+        local count = redis.call("ZCARD", key)
+        local sum = 0
+        if qes.MaxSum > 0 then
+            sum = tonumber(redis.call("GET", keyString(qes.SumTotalKey)) or 0)
+        end
+
+        local keep = {}
+        for i = 1, #qes.Keep do
+            keep[expandID(qes.Keep[i]).T] = true
+        end
+
+        local output = {}
+        local pos = 0
+        while (qes.MaxCount > 0 and count > qes.MaxCount) or
+            (qes.MaxSum > 0 and sum > qes.MaxSum) do
+            -- Take as many of the oldest IDs as it takes to get within
+            -- MaxCount, or one at a time once within it
+            local n = 1
+            if qes.MaxCount > 0 and count - qes.MaxCount > n then
+                n = count - qes.MaxCount
+            end
+            local ret = redis.call("ZRANGE", key, pos, pos + n - 1)
+            if #ret == 0 then break end
+            pos = pos + #ret
+            for i = 1, #ret do
+                local id = expandID(ret[i])
+                if not keep[id.T] then
+                    table.insert(output, id)
+                    count = count - 1
+                    if qes.MaxSum > 0 then
+                        local scoreRaw = redis.call("ZSCORE", keyString(qes.SumKey), id.packed)
+                        sum = sum - tonumber(scoreRaw or 0)
+                    end
+                end
+            end
+        end
+        return output
+
     elseif #qs.PosRangeSelect > 0 then
         local pr = qs.PosRangeSelect
         return redis.call("ZRANGE", key, pr[1], pr[2])
@@ -127,6 +179,9 @@ local function query_filter(input, qf)
         local filter
         if qf.Expired then
             filter = id.Expire <= nowTS
+        elseif qf.InKey then
+            local scoreRaw = redis.call("ZSCORE", keyString(qf.InKey), id.packed)
+            filter = scoreRaw ~= false and score_in_range(tonumber(scoreRaw), qf.ScoreRange)
         end
         -- ~= is not equals, which is synonomous with xor
         filter = filter ~= qf.Invert
@@ -178,6 +233,14 @@ local function query_action(input, qa)
         return input, false
     end
 
+    if qa.LimitInput > 0 then
+        local output = {}
+        for i = 1, math.min(#input, qa.LimitInput) do
+            table.insert(output, input[i])
+        end
+        return output, false
+    end
+
     if qa.QueryAddTo then
         for i = 1, #qa.QueryAddTo.Keys do
             local key = keyString(qa.QueryAddTo.Keys[i])
@@ -185,7 +248,11 @@ local function query_action(input, qa)
                 local score = input[i].T
                 if qa.QueryAddTo.ExpireAsScore then score = input[i].Expire end
                 if qa.QueryAddTo.Score > 0 then score = qa.QueryAddTo.Score end
-                redis.call("ZADD", key, score, input[i].packed)
+                if qa.QueryAddTo.Incr then
+                    redis.call("ZINCRBY", key, score, input[i].packed)
+                else
+                    redis.call("ZADD", key, score, input[i].packed)
+                end
             end
         end
         return input, false
@@ -201,6 +268,23 @@ local function query_action(input, qa)
         return input, false
     end
 
+    if qa.QueryTally then
+        local qt = qa.QueryTally
+        local key = keyString(qt.Key)
+        local sum = 0
+        for i = 1, #input do
+            local scoreRaw = redis.call("ZSCORE", key, input[i].packed)
+            if scoreRaw then sum = sum + tonumber(scoreRaw) end
+        end
+        if qt.Decr then sum = -sum end
+        if sum ~= 0 then
+            local totalKey = keyString(qt.TotalKey)
+            local total = redis.call("INCRBY", totalKey, string.format("%.0f", sum))
+            if total == 0 then redis.call("DEL", totalKey) end
+        end
+        return input, false
+    end
+
     if qa.QueryRemoveByScore then
         local qrems = qa.QueryRemoveByScore
         local min, max = query_score_range(input, qrems.QueryScoreRange)
@@ -215,16 +299,21 @@ local function query_action(input, qa)
         local qss = qa.QuerySingleSet
         local key = keyString(qss.Key)
         if #input > 0 then
+            local id = input[1]
+            if qss.Newest then id = input[#input] end
             if qss.IfNewer then
                 local oldi = redis.call("GET", key)
                 if oldi then
                     oldi = expandID(oldi)
-                    if oldi.T > input[1].T then
+                    if oldi.T > id.T then
                         return input, false
                     end
                 end
             end
-            redis.call("SET", key, input[1].packed)
+            redis.call("SET", key, id.packed)
+            if qss.ExpireAt > 0 then
+                redis.call("PEXPIREAT", key, math.ceil(qss.ExpireAt / 1000))
+            end
         end
         return input, false
     end
@@ -3,8 +3,10 @@ package main
 import (
 	"errors"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/levenlabs/golib/timeutil"
@@ -16,25 +18,67 @@ import (
 type dispatchFn struct {
 	fn      func([]string) (interface{}, error)
 	minArgs int
+
+	// The permission needed to run the command when access control is
+	// enabled, see authorize
+	perm aclPerm
 }
 
 var dispatchTable = map[string]dispatchFn{
-	"PING":    {ping, 0},
-	"QADD":    {qadd, 3},
-	"QGET":    {qget, 2},
-	"QACK":    {qack, 3},
-	"QSTATUS": {qstatus, 0},
-	"QINFO":   {qinfo, 0},
+	"PING":       {ping, 0, permNone},
+	"QADD":       {qadd, 3, permAdd},
+	"QMADD":      {qmadd, 3, permAdd},
+	"QGET":       {qget, 2, permConsume},
+	"QPEEK":      {qpeek, 2, permConsume},
+	"QACK":       {qack, 3, permConsume},
+	"QNACK":      {qnack, 3, permConsume},
+	"QTOUCH":     {qtouch, 4, permConsume},
+	"QSEEK":      {qseek, 3, permConsume},
+	"QSUBSCRIBE": {qsubscribe, 2, permConsume},
+	"QCONSUMERS": {qconsumers, 2, permAdmin},
+	"QDELGROUP":  {qdelgroup, 2, permAdmin},
+	"QREM":       {qrem, 2, permAdmin},
+	"QPURGE":     {qpurge, 1, permAdmin},
+	"QDEL":       {qdel, 1, permAdmin},
+	"QSTATUS":    {qstatus, 0, permAdmin},
+	"QINFO":      {qinfo, 0, permAdmin},
 }
 
+// shutdownCh is closed once the server begins shutting down. Any commands
+// dispatched after that point are refused, and blocking commands which are in
+// progress return early.
+var shutdownCh = make(chan struct{})
+
+// inFlight is read-locked for as long as a command is being dispatched, so that
+// shutting down can wait on all of them by write-locking it
+var inFlight sync.RWMutex
+
+var errShuttingDown = errors.New("server is shutting down")
+
 func dispatch(cmd string, args []string) (interface{}, error) {
+	inFlight.RLock()
+	defer inFlight.RUnlock()
+	select {
+	case <-shutdownCh:
+		return errShuttingDown, nil
+	default:
+	}
+
 	fn, ok := dispatchTable[cmd]
 	if !ok {
 		return fmt.Errorf("unknown cmd %q", cmd), nil
-	} else if len(args) < fn.minArgs {
-		return errors.New("insufficient arguments"), nil
 	}
-	return fn.fn(args)
+
+	start := time.Now()
+	var ret interface{}
+	var err error
+	if len(args) < fn.minArgs {
+		ret = errors.New("insufficient arguments")
+	} else {
+		ret, err = fn.fn(args)
+	}
+	observeCommand(cmd, start, ret, err)
+	return ret, err
 }
 
 func timeFromStr(now time.Time, str string) (time.Time, error) {
@@ -58,6 +102,31 @@ func timeFromStr(now time.Time, str string) (time.Time, error) {
 	return now.Add(d), nil
 }
 
+// parseOpts parses the options in args, which may be given in any order. arity
+// maps each option a command accepts to the number of arguments it takes. fn is
+// called for each option in args, in order, with its uppercased name and its
+// arguments. An error is returned if an unknown option is found, if an option
+// is missing arguments, or if fn returns one.
+func parseOpts(args []string, arity map[string]int, fn func(opt string, vals []string) error) error {
+	for len(args) > 0 {
+		opt := strings.ToUpper(args[0])
+		n, ok := arity[opt]
+		if !ok {
+			return fmt.Errorf("unknown option %q", args[0])
+		} else if len(args) <= n && n == 1 {
+			return fmt.Errorf("%s requires an argument", opt)
+		} else if len(args) <= n {
+			return fmt.Errorf("%s requires %d arguments", opt, n)
+		}
+
+		if err := fn(opt, args[1:n+1]); err != nil {
+			return err
+		}
+		args = args[n+1:]
+	}
+	return nil
+}
+
 func ping(args []string) (interface{}, error) {
 	return redis.NewRespSimple("PONG"), nil
 }
@@ -75,16 +144,92 @@ func qadd(args []string) (interface{}, error) {
 		Contents: args[2],
 	}
 
-	if len(args) > 3 && strings.ToUpper(args[3]) == "NOBLOCK" {
+	var noBlock bool
+	err = parseOpts(args[3:], map[string]int{
+		"DELAY":    1,
+		"AT":       1,
+		"PRIORITY": 1,
+		"HEADER":   2,
+		"DEDUP":    1,
+		"BLOCK":    1,
+		"NOBLOCK":  0,
+	}, func(opt string, vals []string) error {
+		var err error
+		switch opt {
+		case "DELAY", "AT":
+			if !qadd.Available.IsZero() {
+				return errors.New("only one of DELAY or AT may be given")
+			}
+			str := vals[0]
+			if opt == "AT" {
+				str = "@" + str
+			}
+			qadd.Available, err = timeFromStr(now, str)
+		case "PRIORITY":
+			qadd.Priority, err = strconv.Atoi(vals[0])
+		case "HEADER":
+			if qadd.Headers == nil {
+				qadd.Headers = map[string]string{}
+			}
+			qadd.Headers[vals[0]] = vals[1]
+		case "DEDUP":
+			qadd.DedupKey = vals[0]
+		case "BLOCK":
+			qadd.BlockUntil, err = timeFromStr(now, vals[0])
+		case "NOBLOCK":
+			noBlock = true
+		}
+		return err
+	})
+	if err != nil {
+		return err, nil
+	}
+
+	if noBlock {
+		// NOBLOCK adds may still be processed after shutdown begins, see
+		// bgQAddStopCh
+		qadd.StopCh = bgQAddStopCh
 		select {
 		case bgQAddCh <- qadd:
 			return redis.NewRespSimple("OK"), nil
 		default:
+			metricBGQAddDropped.Inc()
 			return nil, errors.New("bgQAdd processes all busy and buffer is full")
 		}
 	}
 
-	return p.QAdd(qadd)
+	qadd.StopCh = shutdownCh
+	id, err := p.QAdd(qadd)
+	switch err {
+	case peel.ErrInvalidPriority, peel.ErrQueueFull, peel.ErrTooLarge:
+		return err, nil
+	}
+	return id, err
+}
+
+func qmadd(args []string) (interface{}, error) {
+	expire, err := timeFromStr(time.Now(), args[1])
+	if err != nil {
+		return err, nil
+	}
+
+	ii, err := p.QAddBatch(peel.QAddBatchCommand{
+		Queue:    args[0],
+		Expire:   expire,
+		Contents: args[2:],
+		StopCh:   shutdownCh,
+	})
+	if err == peel.ErrQueueFull || err == peel.ErrTooLarge {
+		return err, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	ret := make([]string, len(ii))
+	for i := range ii {
+		ret[i] = ii[i].String()
+	}
+	return ret, nil
 }
 
 func qget(args []string) (interface{}, error) {
@@ -93,39 +238,109 @@ func qget(args []string) (interface{}, error) {
 	qget := peel.QGetCommand{
 		Queue:         args[0],
 		ConsumerGroup: args[1],
+		StopCh:        shutdownCh,
 	}
-	args = args[2:]
 
-	timeKV := func(k string) (time.Time, error) {
-		if len(args) < 2 {
-			return time.Time{}, nil
-		}
-		if strings.ToUpper(args[0]) == k {
-			t, err := timeFromStr(now, args[1])
-			if err != nil {
-				return time.Time{}, err
+	var withHeaders bool
+	err := parseOpts(args[2:], map[string]int{
+		"DEADLINE":    1,
+		"BLOCK":       1,
+		"COUNT":       1,
+		"CONSUMER":    1,
+		"WITHHEADERS": 0,
+	}, func(opt string, vals []string) error {
+		var err error
+		switch opt {
+		case "DEADLINE":
+			qget.AckDeadline, err = timeFromStr(now, vals[0])
+		case "BLOCK":
+			qget.BlockUntil, err = timeFromStr(now, vals[0])
+		case "COUNT":
+			if qget.Count, err = strconv.Atoi(vals[0]); err == nil && qget.Count < 1 {
+				err = errors.New("COUNT must be at least 1")
 			}
-			args = args[2:]
-			return t, err
+		case "CONSUMER":
+			qget.Consumer = vals[0]
+		case "WITHHEADERS":
+			withHeaders = true
+		}
+		return err
+	})
+	if err != nil {
+		return err, nil
+	}
+
+	if qget.Count == 0 {
+		e, err := p.QGet(qget)
+		if err != nil {
+			return nil, err
+		} else if (e.ID == core.ID{}) {
+			return nil, nil
 		}
-		return time.Time{}, nil
+		return eventResp(e, withHeaders), nil
 	}
 
-	var err error
-	if qget.AckDeadline, err = timeKV("DEADLINE"); err != nil {
-		return err, nil
+	ee, err := p.QGetBatch(qget)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]interface{}, len(ee))
+	for i, e := range ee {
+		ret[i] = eventResp(e, withHeaders)
+	}
+	return ret, nil
+}
+
+// eventResp returns the array which is returned to clients for an event. If
+// withHeaders is set the event's headers are included as a third element, in
+// the form of a flattened key/value array sorted by key
+func eventResp(e core.Event, withHeaders bool) []interface{} {
+	ret := []interface{}{e.ID.String(), e.Contents}
+	if !withHeaders {
+		return ret
+	}
+
+	keys := make([]string, 0, len(e.Headers))
+	for k := range e.Headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	headers := make([]string, 0, len(keys)*2)
+	for _, k := range keys {
+		headers = append(headers, k, e.Headers[k])
+	}
+	return append(ret, headers)
+}
+
+func qpeek(args []string) (interface{}, error) {
+	qpeek := peel.QPeekCommand{
+		Queue:         args[0],
+		ConsumerGroup: args[1],
 	}
-	if qget.BlockUntil, err = timeKV("BLOCK"); err != nil {
+
+	err := parseOpts(args[2:], map[string]int{
+		"COUNT": 1,
+	}, func(opt string, vals []string) error {
+		var err error
+		if qpeek.Count, err = strconv.Atoi(vals[0]); err == nil && qpeek.Count < 1 {
+			err = errors.New("COUNT must be at least 1")
+		}
+		return err
+	})
+	if err != nil {
 		return err, nil
 	}
 
-	e, err := p.QGet(qget)
+	ee, err := p.QPeek(qpeek)
 	if err != nil {
 		return nil, err
-	} else if (e == core.Event{}) {
-		return nil, nil
 	}
-	return []string{e.ID.String(), e.Contents}, nil
+	ret := make([]interface{}, len(ee))
+	for i, e := range ee {
+		ret[i] = eventResp(e, false)
+	}
+	return ret, nil
 }
 
 func qack(args []string) (interface{}, error) {
@@ -134,36 +349,218 @@ func qack(args []string) (interface{}, error) {
 		return err, nil
 	}
 
-	return p.QAck(peel.QAckCommand{
+	qack := peel.QAckCommand{
 		Queue:         args[0],
 		ConsumerGroup: args[1],
 		EventID:       id,
+	}
+
+	if err := parseOwnerOpts(args[3:], &qack.Consumer, &qack.Force); err != nil {
+		return err, nil
+	}
+
+	acked, err := p.QAck(qack)
+	if nerr, ok := err.(peel.NotOwnerError); ok {
+		return nerr, nil
+	}
+	return acked, err
+}
+
+// parseOwnerOpts parses the CONSUMER and FORCE options shared by the commands
+// which act on an in-progress event
+func parseOwnerOpts(args []string, consumer *string, force *bool) error {
+	return parseOpts(args, map[string]int{
+		"CONSUMER": 1,
+		"FORCE":    0,
+	}, func(opt string, vals []string) error {
+		switch opt {
+		case "CONSUMER":
+			*consumer = vals[0]
+		case "FORCE":
+			*force = true
+		}
+		return nil
 	})
 }
 
-func argsToQCG(args []string) map[string][]string {
-	m := map[string][]string{}
-	var lastQueue string
-	for {
+func qnack(args []string) (interface{}, error) {
+	id, err := core.IDFromString(args[2])
+	if err != nil {
+		return err, nil
+	}
+
+	qnack := peel.QNackCommand{
+		Queue:         args[0],
+		ConsumerGroup: args[1],
+		EventID:       id,
+	}
+	if err := parseOwnerOpts(args[3:], &qnack.Consumer, &qnack.Force); err != nil {
+		return err, nil
+	}
+
+	nacked, err := p.QNack(qnack)
+	if nerr, ok := err.(peel.NotOwnerError); ok {
+		return nerr, nil
+	}
+	return nacked, err
+}
+
+func qtouch(args []string) (interface{}, error) {
+	id, err := core.IDFromString(args[2])
+	if err != nil {
+		return err, nil
+	}
+
+	deadline, err := timeFromStr(time.Now(), args[3])
+	if err != nil {
+		return err, nil
+	}
+
+	qextend := peel.QExtendCommand{
+		Queue:         args[0],
+		ConsumerGroup: args[1],
+		EventID:       id,
+		AckDeadline:   deadline,
+	}
+	if err := parseOwnerOpts(args[4:], &qextend.Consumer, &qextend.Force); err != nil {
+		return err, nil
+	}
+
+	extended, err := p.QExtend(qextend)
+	if nerr, ok := err.(peel.NotOwnerError); ok {
+		return nerr, nil
+	}
+	return extended, err
+}
+
+func qseek(args []string) (interface{}, error) {
+	qseek := peel.QSeekCommand{
+		Queue:         args[0],
+		ConsumerGroup: args[1],
+	}
+	args = args[2:]
+
+	var err error
+	switch strings.ToUpper(args[0]) {
+	case "ID", "TIME":
 		if len(args) < 2 {
-			break
+			return fmt.Errorf("%s requires an argument", strings.ToUpper(args[0])), nil
+		} else if strings.ToUpper(args[0]) == "ID" {
+			qseek.EventID, err = core.IDFromString(args[1])
+		} else {
+			qseek.Time, err = timeFromStr(time.Now(), "@"+args[1])
+		}
+		if err != nil {
+			return err, nil
+		}
+		args = args[2:]
+	case "EARLIEST":
+		args = args[1:]
+	case "LATEST":
+		qseek.Latest = true
+		args = args[1:]
+	default:
+		return fmt.Errorf("invalid seek position %q", args[0]), nil
+	}
+
+	err = parseOpts(args, map[string]int{
+		"CLEARREDO": 0,
+	}, func(opt string, vals []string) error {
+		qseek.ClearRedo = true
+		return nil
+	})
+	if err != nil {
+		return err, nil
+	}
+
+	if err := p.QSeek(qseek); err != nil {
+		return nil, err
+	}
+	return redis.NewRespSimple("OK"), nil
+}
+
+func qdelgroup(args []string) (interface{}, error) {
+	if err := p.DeleteConsumerGroup(args[0], args[1]); err != nil {
+		return nil, err
+	}
+	return redis.NewRespSimple("OK"), nil
+}
+
+func qrem(args []string) (interface{}, error) {
+	id, err := core.IDFromString(args[1])
+	if err != nil {
+		return err, nil
+	}
+
+	return p.QRem(peel.QRemCommand{
+		Queue:   args[0],
+		EventID: id,
+	})
+}
+
+func qpurge(args []string) (interface{}, error) {
+	if err := p.PurgeQueue(args[0]); err != nil {
+		return nil, err
+	}
+	return redis.NewRespSimple("OK"), nil
+}
+
+func qdel(args []string) (interface{}, error) {
+	if err := p.DeleteQueue(args[0]); err != nil {
+		return nil, err
+	}
+	return redis.NewRespSimple("OK"), nil
+}
+
+func qconsumers(args []string) (interface{}, error) {
+	css, err := p.QConsumers(args[0], args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]interface{}, 0, len(css)*2)
+	for _, cs := range css {
+		csret := []interface{}{
+			"lastseen", timeutil.Timestamp{Time: cs.LastSeen}.String(),
+			"inprogress", cs.InProgress,
 		}
-		if up := strings.ToUpper(args[0]); up == "QUEUE" {
-			lastQueue = args[1]
+		ret = append(ret, cs.Name, csret)
+	}
+	return ret, nil
+}
+
+func argsToQCG(args []string) (map[string][]string, error) {
+	m := map[string][]string{}
+	var lastQueue string
+	err := parseOpts(args, map[string]int{
+		"QUEUE": 1,
+		"GROUP": 1,
+	}, func(opt string, vals []string) error {
+		switch opt {
+		case "QUEUE":
+			lastQueue = vals[0]
 			if _, ok := m[lastQueue]; !ok {
 				m[lastQueue] = nil
 			}
-		} else if up == "GROUP" {
-			m[lastQueue] = append(m[lastQueue], args[1])
+		case "GROUP":
+			if lastQueue == "" {
+				return errors.New("GROUP must follow a QUEUE")
+			}
+			m[lastQueue] = append(m[lastQueue], vals[0])
 		}
-		args = args[2:]
-	}
-	return m
+		return nil
+	})
+	return m, err
 }
 
 func qstatus(args []string) (interface{}, error) {
+	qcg, err := argsToQCG(args)
+	if err != nil {
+		return err, nil
+	}
+
 	qsm, err := p.QStatus(peel.QStatusCommand{
-		QueuesConsumerGroups: argsToQCG(args),
+		QueuesConsumerGroups: qcg,
 	})
 	if err != nil {
 		return nil, err
@@ -172,7 +569,7 @@ func qstatus(args []string) (interface{}, error) {
 	ret := []interface{}{}
 	for q, qs := range qsm {
 		ret = append(ret, q)
-		qsret := []interface{}{"total", qs.Total}
+		qsret := []interface{}{"total", qs.Total, "scheduled", qs.Scheduled}
 
 		cgsret := []interface{}{}
 		for cg, cgs := range qs.ConsumerGroupStats {
@@ -180,6 +577,7 @@ func qstatus(args []string) (interface{}, error) {
 				"available", cgs.Available,
 				"inprogress", cgs.InProgress,
 				"redo", cgs.Redo,
+				"dead", cgs.Dead,
 			}
 			cgsret = append(cgsret, cg, cgret)
 		}
@@ -192,7 +590,12 @@ func qstatus(args []string) (interface{}, error) {
 }
 
 func qinfo(args []string) (interface{}, error) {
+	qcg, err := argsToQCG(args)
+	if err != nil {
+		return err, nil
+	}
+
 	return p.QInfo(peel.QStatusCommand{
-		QueuesConsumerGroups: argsToQCG(args),
+		QueuesConsumerGroups: qcg,
 	})
 }
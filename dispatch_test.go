@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/levenlabs/golib/timeutil"
+	"github.com/mediocregopher/bananaq/core"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -22,3 +23,58 @@ func TestTimeFromStr(t *T) {
 	assert.True(t, now.Add(29*time.Second).Before(ts))
 	assert.True(t, now.Add(31*time.Second).After(ts))
 }
+
+func TestEventResp(t *T) {
+	e := core.Event{
+		ID:       core.ID{T: 1, Expire: 2},
+		Contents: "foo",
+		Headers:  map[string]string{"b": "2", "a": "1"},
+	}
+
+	assert.Equal(t, []interface{}{"1_2", "foo"}, eventResp(e, false))
+	assert.Equal(t,
+		[]interface{}{"1_2", "foo", []string{"a", "1", "b", "2"}},
+		eventResp(e, true),
+	)
+
+	e.Headers = nil
+	assert.Equal(t, []interface{}{"1_2", "foo", []string{}}, eventResp(e, true))
+}
+
+func TestParseOpts(t *T) {
+	arity := map[string]int{"FOO": 0, "BAR": 1, "BAZ": 2}
+	parse := func(args ...string) ([][]string, error) {
+		var got [][]string
+		err := parseOpts(args, arity, func(opt string, vals []string) error {
+			got = append(got, append([]string{opt}, vals...))
+			return nil
+		})
+		return got, err
+	}
+
+	got, err := parse("baz", "1", "2", "FOO", "bar", "3")
+	assert.Nil(t, err)
+	assert.Equal(t, [][]string{{"BAZ", "1", "2"}, {"FOO"}, {"BAR", "3"}}, got)
+
+	got, err = parse()
+	assert.Nil(t, err)
+	assert.Empty(t, got)
+
+	_, err = parse("FOO", "QUX")
+	assert.NotNil(t, err)
+
+	_, err = parse("FOO", "BAZ", "1")
+	assert.NotNil(t, err)
+}
+
+func TestArgsToQCG(t *T) {
+	qcg, err := argsToQCG([]string{"QUEUE", "a", "GROUP", "x", "queue", "b", "GROUP", "y", "GROUP", "z"})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string][]string{"a": {"x"}, "b": {"y", "z"}}, qcg)
+
+	_, err = argsToQCG([]string{"GROUP", "x", "QUEUE", "a"})
+	assert.NotNil(t, err)
+
+	_, err = argsToQCG([]string{"QUEUE", "a", "GROUP"})
+	assert.NotNil(t, err)
+}
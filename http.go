@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/levenlabs/go-llog"
+	"github.com/mediocregopher/radix.v2/redis"
+)
+
+const (
+	// httpMaxBodySize is the largest request body, in bytes, which will be read
+	httpMaxBodySize = 32 << 20
+
+	// httpReadHeaderTimeout is how long clients have to send a request's
+	// headers before the connection is closed
+	httpReadHeaderTimeout = 10 * time.Second
+)
+
+// serveHTTP serves all commands in dispatchTable as JSON over http on the given
+// address in the background. See httpHandler for the format. If tlsConf is not
+// nil it is used to serve https instead. The returned server should be Shutdown
+// to stop serving.
+func serveHTTP(addr string, tlsConf *tls.Config) *http.Server {
+	kv := llog.KV{"httpAddr": addr, "tls": tlsConf != nil}
+	llog.Info("starting http listen", kv)
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		llog.Fatal("error listening for http", kv, llog.KV{"err": err})
+	}
+	if tlsConf != nil {
+		l = tls.NewListener(l, tlsConf)
+	}
+
+	srv := &http.Server{
+		Handler:           http.HandlerFunc(httpHandler),
+		ReadHeaderTimeout: httpReadHeaderTimeout,
+	}
+	go func() {
+		if err := srv.Serve(l); err != http.ErrServerClosed {
+			llog.Fatal("error serving http", kv, llog.KV{"err": err})
+		}
+	}()
+	return srv
+}
+
+type httpRes struct {
+	Result interface{} `json:"result"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// httpHandler handles a single command sent over http. The command is taken
+// from the path, e.g. "/QADD", and the request body is a JSON array of the
+// command's arguments, exactly as they would be given over the redis protocol.
+// Arguments may be strings or numbers, and the body may be no larger than
+// httpMaxBodySize. The response is a JSON object with
+// either a "result" or an "error" field.
+func httpHandler(w http.ResponseWriter, r *http.Request) {
+	writeRes := func(code int, res httpRes) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(res)
+	}
+
+	if r.Method != "POST" {
+		writeRes(http.StatusMethodNotAllowed, httpRes{Error: "method must be POST"})
+		return
+	}
+
+	cmd := strings.ToUpper(strings.Trim(r.URL.Path, "/"))
+	kv := llog.KV{"remoteAddr": r.RemoteAddr, "cmd": cmd}
+
+	var rawArgs []interface{}
+	if r.ContentLength != 0 {
+		dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, httpMaxBodySize))
+		dec.UseNumber()
+		if err := dec.Decode(&rawArgs); err != nil {
+			err = fmt.Errorf("invalid arguments: %s", err)
+			writeRes(http.StatusBadRequest, httpRes{Error: err.Error()})
+			return
+		}
+	}
+
+	args := make([]string, len(rawArgs))
+	for i, rawArg := range rawArgs {
+		switch arg := rawArg.(type) {
+		case string:
+			args[i] = arg
+		case json.Number:
+			args[i] = arg.String()
+		default:
+			err := fmt.Errorf("invalid argument %d: must be a string or number", i)
+			writeRes(http.StatusBadRequest, httpRes{Error: err.Error()})
+			return
+		}
+	}
+
+	llog.Debug("http command", kv)
+
+	// When access control is enabled clients authenticate using basic auth on
+	// each request
+	var user *aclUser
+	if name, password, ok := r.BasicAuth(); ok && acl != nil {
+		var err error
+		if user, err = acl.auth(name, password); err != nil {
+			llog.Warn("http client failed to authenticate", kv, llog.KV{"user": name})
+			writeRes(http.StatusUnauthorized, httpRes{Error: err.Error()})
+			return
+		}
+	}
+	if err := authorize(user, cmd, args); err != nil {
+		llog.Warn("http client not authorized for command", kv, llog.KV{"err": err})
+		code := http.StatusForbidden
+		if user == nil {
+			code = http.StatusUnauthorized
+		}
+		writeRes(code, httpRes{Error: err.Error()})
+		return
+	}
+
+	// Subscriptions need a persistent connection to push events over
+	if cmd == "QSUBSCRIBE" {
+		writeRes(http.StatusBadRequest, httpRes{Error: errNotHTTP.Error()})
+		return
+	}
+
+	// ret may be an error if it's a client error (e.g. invalid params)
+	if ret, err := dispatch(cmd, args); err != nil {
+		llog.Error("error dispatching http command", kv, llog.KV{"err": err})
+		err = fmt.Errorf("server-side error: %s", err)
+		writeRes(http.StatusInternalServerError, httpRes{Error: err.Error()})
+	} else if rerr, ok := ret.(error); ok {
+		llog.Warn("client error dispatching http command", kv, llog.KV{"err": rerr})
+		writeRes(http.StatusBadRequest, httpRes{Error: rerr.Error()})
+	} else {
+		writeRes(http.StatusOK, httpRes{Result: jsonValue(ret)})
+	}
+}
+
+// jsonValue converts a return value from a dispatch function into a value
+// which will encode to sensible JSON
+func jsonValue(ret interface{}) interface{} {
+	switch v := ret.(type) {
+	case *redis.Resp:
+		s, _ := v.Str()
+		return s
+	case fmt.Stringer:
+		return v.String()
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i := range v {
+			out[i] = jsonValue(v[i])
+		}
+		return out
+	default:
+		return v
+	}
+}
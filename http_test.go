@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	. "testing"
+
+	"github.com/mediocregopher/bananaq/core"
+	"github.com/mediocregopher/radix.v2/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPHandler(t *T) {
+	do := func(method, path, body string) (int, httpRes) {
+		r := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+		w := httptest.NewRecorder()
+		httpHandler(w, r)
+
+		var res httpRes
+		require.Nil(t, json.NewDecoder(w.Body).Decode(&res))
+		return w.Code, res
+	}
+
+	code, res := do("POST", "/ping", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, httpRes{Result: "PONG"}, res)
+
+	code, res = do("POST", "/PING", `[]`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, httpRes{Result: "PONG"}, res)
+
+	code, res = do("GET", "/PING", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, code)
+	assert.NotEmpty(t, res.Error)
+
+	code, res = do("POST", "/FOO", `[]`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, `unknown cmd "FOO"`, res.Error)
+
+	code, res = do("POST", "/QADD", `["foo", 30]`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, "insufficient arguments", res.Error)
+
+	code, res = do("POST", "/QADD", `["foo", {}, "bar"]`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.NotEmpty(t, res.Error)
+
+	big := strings.Repeat("a", httpMaxBodySize)
+	code, res = do("POST", "/QADD", `["foo", 30, "`+big+`"]`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Contains(t, res.Error, "too large")
+}
+
+func TestJSONValue(t *T) {
+	ret := []interface{}{
+		redis.NewRespSimple("OK"),
+		core.ID{T: 1, Expire: 2},
+		[]interface{}{"foo", uint64(3)},
+		true,
+	}
+	expected := []interface{}{
+		"OK",
+		"1_2",
+		[]interface{}{"foo", uint64(3)},
+		true,
+	}
+	assert.Equal(t, expected, jsonValue(ret))
+}
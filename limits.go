@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+
+	"github.com/mediocregopher/bananaq/peel"
+)
+
+var overflowPolicies = map[string]peel.OverflowPolicy{
+	"reject": peel.OverflowReject,
+	"drop":   peel.OverflowDrop,
+	"block":  peel.OverflowBlock,
+}
+
+// limitsConfig describes how much each queue may hold, and what happens when a
+// queue is full. It's loaded from --queue-limits-file.
+type limitsConfig struct {
+	Rules []limitsRule `json:"rules"`
+}
+
+// limitsRule applies limits to all queues whose names match the Queues pattern.
+// The pattern uses the syntax of path.Match. Overflow is one of the keys of
+// overflowPolicies, and defaults to "reject".
+type limitsRule struct {
+	Queues    string `json:"queues"`
+	MaxLength int64  `json:"maxLength"`
+	MaxBytes  int64  `json:"maxBytes"`
+	Overflow  string `json:"overflow"`
+}
+
+func loadLimits(filename string) (*limitsConfig, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var lc limitsConfig
+	if err := json.Unmarshal(b, &lc); err != nil {
+		return nil, err
+	}
+
+	for _, rule := range lc.Rules {
+		if _, err := path.Match(rule.Queues, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %s", rule.Queues, err)
+		}
+		if _, ok := overflowPolicies[rule.Overflow]; !ok && rule.Overflow != "" {
+			return nil, fmt.Errorf("rule for %q has unknown overflow %q", rule.Queues, rule.Overflow)
+		}
+		if rule.MaxLength < 0 || rule.MaxBytes < 0 {
+			return nil, fmt.Errorf("rule for %q has a negative limit", rule.Queues)
+		}
+	}
+
+	return &lc, nil
+}
+
+// limits returns the limits from the first rule whose pattern matches the given
+// queue. If none match the queue has no limits.
+func (lc *limitsConfig) limits(queue string) peel.QueueLimits {
+	for _, rule := range lc.Rules {
+		if ok, _ := path.Match(rule.Queues, queue); ok {
+			return peel.QueueLimits{
+				MaxLength: rule.MaxLength,
+				MaxBytes:  rule.MaxBytes,
+				Overflow:  overflowPolicies[rule.Overflow],
+			}
+		}
+	}
+	return peel.QueueLimits{}
+}
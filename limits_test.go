@@ -0,0 +1,45 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	. "testing"
+
+	"github.com/mediocregopher/bananaq/peel"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadLimits(t *T) {
+	load := func(body string) (*limitsConfig, error) {
+		f, err := ioutil.TempFile("", "bananaq-limits")
+		require.Nil(t, err)
+		defer os.Remove(f.Name())
+		_, err = f.WriteString(body)
+		require.Nil(t, err)
+		require.Nil(t, f.Close())
+		return loadLimits(f.Name())
+	}
+
+	lc, err := load(`{"rules":[
+		{"queues":"logs-*","maxBytes":1024,"overflow":"drop"},
+		{"queues":"*","maxLength":10}
+	]}`)
+	require.Nil(t, err)
+	assert.Equal(t, peel.QueueLimits{MaxBytes: 1024, Overflow: peel.OverflowDrop}, lc.limits("logs-a"))
+	assert.Equal(t, peel.QueueLimits{MaxLength: 10, Overflow: peel.OverflowReject}, lc.limits("jobs"))
+
+	lc, err = load(`{"rules":[{"queues":"a-*","maxLength":10,"overflow":"block"}]}`)
+	require.Nil(t, err)
+	assert.Equal(t, peel.QueueLimits{MaxLength: 10, Overflow: peel.OverflowBlock}, lc.limits("a-1"))
+	assert.Equal(t, peel.QueueLimits{}, lc.limits("b-1"))
+
+	_, err = load(`{"rules":[{"queues":"*","maxLength":10,"overflow":"explode"}]}`)
+	assert.NotNil(t, err)
+
+	_, err = load(`{"rules":[{"queues":"[","maxLength":10}]}`)
+	assert.NotNil(t, err)
+
+	_, err = load(`{"rules":[{"queues":"*","maxBytes":-1}]}`)
+	assert.NotNil(t, err)
+}
@@ -1,14 +1,25 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
+	"net/http"
+	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/levenlabs/go-llog"
 	"github.com/levenlabs/golib/radixutil"
+	"github.com/mediocregopher/bananaq/core"
 	"github.com/mediocregopher/bananaq/peel"
 	"github.com/mediocregopher/lever"
 	"github.com/mediocregopher/radix.v2/redis"
@@ -19,6 +30,14 @@ import (
 
 var p *peel.Peel
 var bgQAddCh chan peel.QAddCommand
+var bgQAddWG sync.WaitGroup
+
+// bgQAddStopCh is closed if the bgQAdd routines are still busy
+// bgQAddDrainTimeout after shutdown begins, so that NOBLOCK adds waiting for
+// room in a full queue give up
+var bgQAddStopCh = make(chan struct{})
+
+const bgQAddDrainTimeout = 30 * time.Second
 
 func main() {
 	l := lever.New("bananaq", nil)
@@ -27,6 +46,34 @@ func main() {
 		Description: "Address to listen for client connections on",
 		Default:     ":5777",
 	})
+	l.Add(lever.Param{
+		Name:        "--tls-cert",
+		Description: "Path to a PEM encoded certificate file. If set along with --tls-key, clients must connect using TLS",
+	})
+	l.Add(lever.Param{
+		Name:        "--tls-key",
+		Description: "Path to the PEM encoded private key file for --tls-cert",
+	})
+	l.Add(lever.Param{
+		Name:        "--tls-client-ca",
+		Description: "Path to a PEM encoded CA certificate file. If set, clients must present a TLS certificate signed by it",
+	})
+	l.Add(lever.Param{
+		Name:        "--acl-file",
+		Description: "Path to a JSON file describing users and what they may do. If set, clients must AUTH before running most commands",
+	})
+	l.Add(lever.Param{
+		Name:        "--queue-limits-file",
+		Description: "Path to a JSON file describing how many events, or bytes of events, queues may hold and what happens when they're full. If not set queues only shrink as their events expire",
+	})
+	l.Add(lever.Param{
+		Name:        "--http-addr",
+		Description: "Address to listen for commands over http on, in addition to --listen-addr. The http api is not served if this is empty",
+	})
+	l.Add(lever.Param{
+		Name:        "--metrics-addr",
+		Description: "Address to serve prometheus metrics over http on, at /metrics. Metrics are not served if this is empty",
+	})
 	l.Add(lever.Param{
 		Name:        "--redis-addr",
 		Description: "Address redis is listening on. May be a solo redis instance or a node in a cluster",
@@ -42,6 +89,26 @@ func main() {
 		Description: "Log level to run with. Can be debug, info, warn, error, fatal",
 		Default:     "info",
 	})
+	l.Add(lever.Param{
+		Name:        "--max-deliveries",
+		Description: "Number of times an event may be retrieved by a consumer group with a DEADLINE before it is considered dead instead of being redone. 0 means no limit",
+		Default:     "0",
+	})
+	l.Add(lever.Param{
+		Name:        "--priority-levels",
+		Description: "Number of priority levels events may be added with. Valid priorities go from 0 (the lowest) up to one less than this",
+		Default:     "1",
+	})
+	l.Add(lever.Param{
+		Name:        "--dedup-window",
+		Description: "Number of seconds after an event is added with a DEDUP key during which further events added to the same queue with that key are considered duplicates",
+		Default:     "300",
+	})
+	l.Add(lever.Param{
+		Name:        "--consumer-expire",
+		Description: "Number of seconds after a consumer named with CONSUMER last retrieved events that it is forgotten, and no longer returned by QCONSUMERS",
+		Default:     "86400",
+	})
 	l.Add(lever.Param{
 		Name:        "--bg-qadd-pool-size",
 		Description: "Number of goroutines to have processing NOBLOCK QADD commands",
@@ -50,13 +117,27 @@ func main() {
 	l.Parse()
 
 	listenAddr, _ := l.ParamStr("--listen-addr")
+	tlsCert, _ := l.ParamStr("--tls-cert")
+	tlsKey, _ := l.ParamStr("--tls-key")
+	tlsClientCA, _ := l.ParamStr("--tls-client-ca")
+	aclFile, _ := l.ParamStr("--acl-file")
+	limitsFile, _ := l.ParamStr("--queue-limits-file")
+	httpAddr, _ := l.ParamStr("--http-addr")
+	metricsAddr, _ := l.ParamStr("--metrics-addr")
 	redisAddr, _ := l.ParamStr("--redis-addr")
 	redisPoolSize, _ := l.ParamInt("--redis-pool-size")
 	logLevel, _ := l.ParamStr("--log-level")
 	bgQAddPoolSize, _ := l.ParamInt("--bg-qadd-pool-size")
+	maxDeliveries, _ := l.ParamInt("--max-deliveries")
+	priorityLevels, _ := l.ParamInt("--priority-levels")
+	dedupWindow, _ := l.ParamInt("--dedup-window")
+	consumerExpire, _ := l.ParamInt("--consumer-expire")
 
 	llog.SetLevelFromString(logLevel)
 
+	peelStopCh := make(chan struct{})
+	peelDoneCh := make(chan struct{})
+
 	// Set up redis/peel
 	{
 		kv := llog.KV{
@@ -69,10 +150,31 @@ func main() {
 			llog.Fatal("could not connect to redis", kv.Set("err", err))
 		}
 
-		p := peel.New(cmder, nil)
+		o := &peel.Opts{
+			MaxDeliveries:  maxDeliveries,
+			PriorityLevels: priorityLevels,
+			DedupWindow:    time.Duration(dedupWindow) * time.Second,
+			ConsumerExpire: time.Duration(consumerExpire) * time.Second,
+		}
+		if limitsFile != "" {
+			lkv := llog.KV{"queueLimitsFile": limitsFile}
+			lc, err := loadLimits(limitsFile)
+			if err != nil {
+				llog.Fatal("error loading queue limits file", lkv, llog.KV{"err": err})
+			}
+			llog.Info("loaded queue limits file", lkv, llog.KV{"numRules": len(lc.Rules)})
+			o.Limits = lc.limits
+		}
+
+		p = peel.New(core.New(cmder, nil), o)
 		go func() {
+			defer close(peelDoneCh)
 			for {
-				err := <-p.Run(nil)
+				// Run only returns nil once peelStopCh is closed
+				err := <-p.Run(peelStopCh)
+				if err == nil {
+					return
+				}
 				llog.Error("error during peel runtime", kv.Set("err", err))
 				time.Sleep(500 * time.Millisecond)
 			}
@@ -87,8 +189,10 @@ func main() {
 		kv := llog.KV{"bgQAddPoolSize": bgQAddPoolSize}
 		llog.Debug("starting bgQAdd routines", kv)
 		bgQAddCh = make(chan peel.QAddCommand, bgQAddPoolSize*10)
+		bgQAddWG.Add(bgQAddPoolSize)
 		for i := 0; i < bgQAddPoolSize; i++ {
 			go func(i int) {
+				defer bgQAddWG.Done()
 				kv = kv.Set("i", i)
 				for qadd := range bgQAddCh {
 					qkv := llog.KV{"queue": qadd.Queue}
@@ -103,20 +207,61 @@ func main() {
 		}
 	}
 
+	if metricsAddr != "" {
+		serveMetrics(metricsAddr)
+	}
+
+	var tlsConf *tls.Config
+	if tlsCert != "" || tlsKey != "" || tlsClientCA != "" {
+		kv := llog.KV{
+			"tlsCert":     tlsCert,
+			"tlsKey":      tlsKey,
+			"tlsClientCA": tlsClientCA,
+		}
+		var err error
+		if tlsConf, err = newTLSConfig(tlsCert, tlsKey, tlsClientCA); err != nil {
+			llog.Fatal("error setting up tls", kv, llog.KV{"err": err})
+		}
+	}
+
+	if aclFile != "" {
+		kv := llog.KV{"aclFile": aclFile}
+		var err error
+		if acl, err = loadACL(aclFile); err != nil {
+			llog.Fatal("error loading acl file", kv, llog.KV{"err": err})
+		}
+		llog.Info("loaded acl file", kv, llog.KV{"numUsers": len(acl.Users)})
+	}
+
+	var httpServer *http.Server
+	if httpAddr != "" {
+		httpServer = serveHTTP(httpAddr, tlsConf)
+	}
+
 	// Start actually listening
+	var server net.Listener
 	{
-		kv := llog.KV{"listenAddr": listenAddr}
+		kv := llog.KV{"listenAddr": listenAddr, "tls": tlsConf != nil}
 
 		llog.Info("starting listen", kv)
-		server, err := net.Listen("tcp", listenAddr)
+		var err error
+		server, err = net.Listen("tcp", listenAddr)
 		if err != nil {
 			llog.Fatal("error listening", kv, llog.KV{"err": err})
 		}
+		if tlsConf != nil {
+			server = tls.NewListener(server, tlsConf)
+		}
 
 		go func() {
 			for {
 				conn, err := server.Accept()
 				if conn == nil {
+					select {
+					case <-shutdownCh:
+						return
+					default:
+					}
 					llog.Error("error accepting", kv.Set("err", err))
 					continue
 				}
@@ -126,8 +271,80 @@ func main() {
 	}
 
 	llog.Info("ready, set, go!")
-	select {}
 
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-sigCh
+	llog.Info("signal received, shutting down", llog.KV{"signal": sig})
+
+	// Stop accepting new connections, then refuse any new commands and wake
+	// up all blocking QGETs
+	close(shutdownCh)
+	server.Close()
+	if httpServer != nil {
+		if err := httpServer.Shutdown(context.Background()); err != nil {
+			llog.Error("error shutting down http", llog.KV{"err": err})
+		}
+	}
+
+	// Wait for all in-flight commands to finish. Nothing can add to bgQAddCh
+	// after this, so it can be closed and drained
+	llog.Info("waiting for in-flight commands")
+	inFlight.Lock()
+
+	llog.Info("draining bgQAdd routines", llog.KV{"buffered": len(bgQAddCh)})
+	close(bgQAddCh)
+	drainTimer := time.AfterFunc(bgQAddDrainTimeout, func() { close(bgQAddStopCh) })
+	bgQAddWG.Wait()
+	drainTimer.Stop()
+
+	close(peelStopCh)
+	<-peelDoneCh
+
+	llog.Info("shutdown complete")
+}
+
+// newTLSConfig returns the tls.Config client connections should be served with.
+// certFile and keyFile are required, and if clientCAFile is given then clients
+// must present a certificate signed by it.
+func newTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("--tls-cert and --tls-key must both be set")
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	conf := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if clientCAFile != "" {
+		caPEM, err := ioutil.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificates found in %q", clientCAFile)
+		}
+		conf.ClientCAs = pool
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return conf, nil
+}
+
+// invalidCmdError is returned when a client sends something which can't be
+// parsed as a command. Unlike other read errors the connection remains usable.
+type invalidCmdError struct {
+	err error
+}
+
+func (e invalidCmdError) Error() string {
+	return fmt.Sprintf("invalid command: %s", e.err)
 }
 
 func serveConn(conn net.Conn) {
@@ -137,10 +354,15 @@ func serveConn(conn net.Conn) {
 	rr := redis.NewRespReader(conn)
 
 	llog.Debug("client connected", kv)
+	metricClients.Inc()
+	defer metricClients.Dec()
 
 	var cmd string
 	var args []string
 
+	// The user the client has authenticated as using AUTH, if any
+	var user *aclUser
+
 	readCmd := func() (string, []string, error) {
 		m := rr.Read()
 		if m.IsType(redis.IOErr) {
@@ -149,13 +371,13 @@ func serveConn(conn net.Conn) {
 
 		parts, err := m.Array()
 		if err != nil {
-			return "", nil, fmt.Errorf("invalid command: %s", err)
+			return "", nil, invalidCmdError{err}
 		}
 		args = args[:0]
 		for i := range parts {
 			val, err := parts[i].Str()
 			if err != nil {
-				return "", nil, fmt.Errorf("invalid command: %s", err)
+				return "", nil, invalidCmdError{err}
 			}
 			if i == 0 {
 				cmd = val
@@ -166,21 +388,78 @@ func serveConn(conn net.Conn) {
 		return strings.ToUpper(cmd), args, nil
 	}
 
+	// Once the client has subscribed events are written to it from another
+	// go-routine, so all writes go through here
+	var wl sync.Mutex
+	write := func(m interface{}) error {
+		wl.Lock()
+		defer wl.Unlock()
+		_, err := redis.NewResp(m).WriteTo(conn)
+		return err
+	}
+
 	writeErr := func(err error) {
-		redis.NewResp(fmt.Errorf("ERR %s", err)).WriteTo(conn)
+		write(fmt.Errorf("ERR %s", err))
+	}
+
+	writeRet := func(cmdKV llog.KV, ret interface{}, err error) {
+		// ret may be an error if it's a client error (e.g. invalid params)
+		if err != nil {
+			llog.Error("error dispatching command", kv, cmdKV, llog.KV{"err": err})
+			writeErr(fmt.Errorf("server-side error: %s", err))
+		} else if rerr, ok := ret.(error); ok {
+			llog.Warn("client error dispatching command", kv, cmdKV, llog.KV{"err": rerr})
+			writeErr(rerr)
+		} else {
+			llog.Debug("client command response", kv, cmdKV, llog.KV{"ret": ret})
+			write(ret)
+		}
 	}
 
+	// Set if the client has sent QSUBSCRIBE
+	var sub *subscription
+	defer func() {
+		if sub != nil {
+			sub.stop()
+		}
+	}()
+
 	for {
 		cmd, args, err := readCmd()
 		if nerr, ok := err.(*net.OpError); ok && nerr.Timeout() {
 			continue
+		} else if _, ok := err.(invalidCmdError); ok {
+			llog.Warn("client sent invalid command", kv, llog.KV{"err": err})
+			writeErr(err)
+			continue
 		} else if err == io.EOF {
 			llog.Debug("client disconnected", kv)
 			conn.Close()
 			return
 		} else if err != nil {
-			llog.Warn("client error reading command", kv.Set("err", err))
-			writeErr(err)
+			// The connection can't be read from anymore (e.g. a failed tls
+			// handshake), so there's nothing to do but drop it
+			llog.Warn("client error reading command", kv, llog.KV{"err": err})
+			conn.Close()
+			return
+		}
+
+		// AUTH is handled here since it changes the state of the connection.
+		// Its args aren't logged, for obvious reasons
+		if cmd == "AUTH" && sub == nil {
+			if acl == nil {
+				writeErr(errNoACL)
+			} else if len(args) < 2 {
+				writeErr(errors.New("insufficient arguments"))
+			} else if u, err := acl.auth(args[0], args[1]); err != nil {
+				llog.Warn("client failed to authenticate", kv, llog.KV{"user": args[0]})
+				writeErr(err)
+			} else {
+				llog.Debug("client authenticated", kv, llog.KV{"user": args[0]})
+				user = u
+				write(redis.NewRespSimple("OK"))
+			}
+			continue
 		}
 
 		shortArgs := make([]string, len(args))
@@ -194,17 +473,35 @@ func serveConn(conn net.Conn) {
 
 		llog.Debug("client command", kv, cmdKV)
 
-		// ret may be an error if it's a client error (e.g. invalid params)
-		if ret, err := dispatch(cmd, args); err != nil {
-			llog.Error("error dispatching command", kv, cmdKV, llog.KV{"err": err})
-			redis.NewResp(fmt.Errorf("server-side error: %s", err)).WriteTo(conn)
-			writeErr(fmt.Errorf("server-side error: %s", err))
-		} else if rerr, ok := ret.(error); ok {
-			llog.Warn("client error dispatching command", kv, cmdKV, llog.KV{"err": rerr})
-			writeErr(rerr)
-		} else {
-			llog.Debug("client command response", kv, cmdKV, llog.KV{"ret": ret})
-			redis.NewResp(ret).WriteTo(conn)
+		// While subscribed only a limited set of commands, all acting on the
+		// subscription, may be used
+		if sub != nil && cmd == "QUNSUBSCRIBE" {
+			sub.stop()
+			sub = nil
+			llog.Debug("client unsubscribed", kv)
+			write(redis.NewRespSimple("OK"))
+			continue
+		} else if sub != nil {
+			ret, err := sub.dispatch(cmd, args)
+			writeRet(cmdKV, ret, err)
+			continue
+		}
+
+		if err := authorize(user, cmd, args); err != nil {
+			llog.Warn("client not authorized for command", kv, cmdKV, llog.KV{"err": err})
+			writeErr(err)
+			continue
+		}
+
+		ret, err := dispatch(cmd, args)
+		if s, ok := ret.(*subscription); ok && err == nil {
+			// OK must be written before any events are
+			llog.Debug("client subscribed", kv, cmdKV)
+			write(redis.NewRespSimple("OK"))
+			sub = s
+			sub.start(write, kv)
+			continue
 		}
+		writeRet(cmdKV, ret, err)
 	}
 }
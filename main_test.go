@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"net"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/radix.v2/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// errConn is a net.Conn whose reads always fail with a non-timeout error, like
+// a tls connection whose handshake failed
+type errConn struct {
+	net.Conn
+}
+
+func (c errConn) Read([]byte) (int, error) {
+	return 0, errors.New("read failed")
+}
+
+func TestServeConn(t *T) {
+	client, server := net.Pipe()
+	go serveConn(server)
+	rr := redis.NewRespReader(client)
+
+	// An invalid command gets an error back, and the connection stays usable
+	_, err := client.Write([]byte("+OK\r\n"))
+	require.Nil(t, err)
+	m := rr.Read()
+	assert.True(t, m.IsType(redis.AppErr), "m:%v", m)
+
+	_, err = redis.NewResp([]string{"PING"}).WriteTo(client)
+	require.Nil(t, err)
+	s, err := rr.Read().Str()
+	require.Nil(t, err)
+	assert.Equal(t, "PONG", s)
+	client.Close()
+
+	// Any other read error causes the connection to be dropped
+	client, server = net.Pipe()
+	defer client.Close()
+	doneCh := make(chan struct{})
+	go func() {
+		serveConn(errConn{server})
+		close(doneCh)
+	}()
+	select {
+	case <-doneCh:
+	case <-time.After(1 * time.Second):
+		assert.Fail(t, "serveConn should have returned")
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/levenlabs/go-llog"
+	"github.com/mediocregopher/bananaq/peel"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "bananaq"
+
+var (
+	metricCommands = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "commands_total",
+			Help:      "Number of commands dispatched, by command and result (ok, client_error or server_error)",
+		},
+		[]string{"cmd", "result"},
+	)
+
+	metricCommandDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "command_duration_seconds",
+			Help:      "Time taken to dispatch commands, by command",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{"cmd"},
+	)
+
+	metricBGQAddDepth = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "bg_qadd_queue_depth",
+			Help:      "Number of NOBLOCK QADD commands waiting to be processed",
+		},
+		func() float64 { return float64(len(bgQAddCh)) },
+	)
+
+	metricBGQAddDropped = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "bg_qadd_dropped_total",
+			Help:      "Number of NOBLOCK QADD commands rejected because the background routines were all busy",
+		},
+	)
+
+	metricClients = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "connected_clients",
+			Help:      "Number of currently connected clients",
+		},
+	)
+)
+
+// observeCommand records the result of a single call to dispatch for the given
+// command, which was started at the given time
+func observeCommand(cmd string, start time.Time, ret interface{}, err error) {
+	result := "ok"
+	if err != nil {
+		result = "server_error"
+	} else if _, ok := ret.(error); ok {
+		result = "client_error"
+	}
+	metricCommands.WithLabelValues(cmd, result).Inc()
+	metricCommandDuration.WithLabelValues(cmd).Observe(time.Since(start).Seconds())
+}
+
+// queueCollector collects gauges for every queue and consumer group from
+// QStatus each time metrics are scraped
+type queueCollector struct {
+	total, scheduled                  *prometheus.Desc
+	available, inProgress, redo, dead *prometheus.Desc
+}
+
+func newQueueCollector() queueCollector {
+	queueDesc := func(name, help string) *prometheus.Desc {
+		fqName := prometheus.BuildFQName(metricsNamespace, "queue", name)
+		return prometheus.NewDesc(fqName, help, []string{"queue"}, nil)
+	}
+	groupDesc := func(name, help string) *prometheus.Desc {
+		fqName := prometheus.BuildFQName(metricsNamespace, "group", name)
+		return prometheus.NewDesc(fqName, help, []string{"queue", "group"}, nil)
+	}
+	return queueCollector{
+		total:      queueDesc("total", "Number of unexpired events in the queue"),
+		scheduled:  queueDesc("scheduled", "Number of events in the queue which aren't available yet"),
+		available:  groupDesc("available", "Number of events the consumer group has yet to process"),
+		inProgress: groupDesc("inprogress", "Number of events currently being worked on by the consumer group"),
+		redo:       groupDesc("redo", "Number of events awaiting being re-attempted by the consumer group"),
+		dead:       groupDesc("dead", "Number of events which won't be re-attempted by the consumer group"),
+	}
+}
+
+func (qc queueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- qc.total
+	ch <- qc.scheduled
+	ch <- qc.available
+	ch <- qc.inProgress
+	ch <- qc.redo
+	ch <- qc.dead
+}
+
+func (qc queueCollector) Collect(ch chan<- prometheus.Metric) {
+	qsm, err := p.QStatus(peel.QStatusCommand{})
+	if err != nil {
+		llog.Error("error getting queue status for metrics", llog.KV{"err": err})
+		return
+	}
+
+	gauge := func(desc *prometheus.Desc, val uint64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, float64(val), labels...)
+	}
+	for q, qs := range qsm {
+		gauge(qc.total, qs.Total, q)
+		gauge(qc.scheduled, qs.Scheduled, q)
+		for cg, cgs := range qs.ConsumerGroupStats {
+			gauge(qc.available, cgs.Available, q, cg)
+			gauge(qc.inProgress, cgs.InProgress, q, cg)
+			gauge(qc.redo, cgs.Redo, q, cg)
+			gauge(qc.dead, cgs.Dead, q, cg)
+		}
+	}
+}
+
+// serveMetrics registers all metrics and serves them over http on the given
+// address in the background
+func serveMetrics(addr string) {
+	prometheus.MustRegister(
+		metricCommands,
+		metricCommandDuration,
+		metricBGQAddDepth,
+		metricBGQAddDropped,
+		metricClients,
+		newQueueCollector(),
+	)
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	kv := llog.KV{"metricsAddr": addr}
+	llog.Info("starting metrics listen", kv)
+	go func() {
+		err := http.ListenAndServe(addr, mux)
+		llog.Fatal("error serving metrics", kv, llog.KV{"err": err})
+	}()
+}
@@ -0,0 +1,37 @@
+package peel
+
+import (
+	"time"
+
+	"github.com/mediocregopher/bananaq/core"
+)
+
+// Backend describes everything Peel needs from the storage layer it's built on
+// top of. *core.Core, which stores everything in redis, is the standard
+// implementation. See the core package for the semantics of each method.
+type Backend interface {
+	// Run performs all the background work needed to support the Backend.
+	// Peel's Run method calls it, so it shouldn't be called separately
+	Run(stopCh chan struct{}) chan error
+
+	NewEvent(now, expire core.TS, contents string) (core.Event, error)
+	NewScheduledEvent(at, expire core.TS, contents string) (core.Event, error)
+	NewEvents(now, expire core.TS, contents []string) ([]core.Event, error)
+
+	SetEvent(e core.Event, expireBuffer time.Duration) error
+	SetEvents(ee []core.Event, expireBuffer time.Duration) error
+	GetEvent(id core.ID) (core.Event, error)
+	GetEvents(ii []core.ID) ([]core.Event, error)
+	DelEvents(ii []core.ID) error
+
+	Query(qas core.QueryActions) (core.QueryRes, error)
+	KeyScan(k core.Key) ([]core.Key, error)
+
+	KeyWait(k core.Key, stopCh <-chan struct{}) <-chan struct{}
+	KeyNotify(k core.Key)
+}
+
+var (
+	_ Backend = (*core.Core)(nil)
+	_ Backend = (*core.Mem)(nil)
+)
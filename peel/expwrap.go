@@ -45,14 +45,29 @@ func (ew exWrap) addFromInput(score core.TS) []core.QueryAction {
 	}
 }
 
+// returns actions which will increment the score of each of the IDs which are
+// input into them by one, adding them to this exWrap if they aren't already in
+// it
+func (ew exWrap) incrFromInput() []core.QueryAction {
+	aa := ew.addFromInput(1)
+	aa[0].QueryAddTo.Incr = true
+	return aa
+}
+
 // returns actions which will add the given ID with the given score. If score is
 // zero then the T field of the ID will be used as the score
 func (ew exWrap) add(id core.ID, score core.TS) []core.QueryAction {
+	return ew.addAll([]core.ID{id}, score)
+}
+
+// returns actions which will add all the given IDs with the given score. If
+// score is zero then the T field of each ID will be used as its score
+func (ew exWrap) addAll(ii []core.ID, score core.TS) []core.QueryAction {
 	aa := make([]core.QueryAction, 1, 3)
 	aa[0] = core.QueryAction{
 		QuerySelector: &core.QuerySelector{
 			Key: ew.byArb,
-			IDs: []core.ID{id},
+			IDs: ii,
 		},
 	}
 	aa = append(aa, ew.addFromInput(score)...)
@@ -68,6 +83,15 @@ func (ew exWrap) removeFromInput() core.QueryAction {
 	}
 }
 
+// returns actions which will delete both underlying sets entirely. input is
+// passed straight through to output
+func (ew exWrap) del() []core.QueryAction {
+	return []core.QueryAction{
+		{Delete: &ew.byArb},
+		{Delete: &ew.byExp},
+	}
+}
+
 // returns actions which will remove all events whose expire has passed (based
 // on the given TS) from both underlying sets. The output from these actions
 // will be the events which were removed
@@ -87,6 +111,20 @@ func (ew exWrap) removeExpired(now core.TS) []core.QueryAction {
 	}
 }
 
+// returns an action which will output the given ID if it's in the set with a
+// score which is not less than min, or no IDs otherwise
+func (ew exWrap) selectID(id core.ID, min core.TS) core.QueryAction {
+	return core.QueryAction{
+		QuerySelector: &core.QuerySelector{
+			Key: ew.byArb,
+			QueryIDScoreSelect: &core.QueryIDScoreSelect{
+				ID:  id,
+				Min: min,
+			},
+		},
+	}
+}
+
 // returns an action which will output either one ID or no IDs. The ID which is
 // output will be the first one which whose score is higher than ts
 
@@ -0,0 +1,362 @@
+package peel
+
+import (
+	"errors"
+	"time"
+
+	"github.com/mediocregopher/bananaq/core"
+)
+
+// ErrQueueFull is returned when adding events to a queue which doesn't have
+// room for them, see QueueLimits
+var ErrQueueFull = errors.New("queue is full")
+
+// ErrTooLarge is returned when adding events which wouldn't fit within their
+// queue's QueueLimits even if the queue were empty
+var ErrTooLarge = errors.New("events are too large for the queue")
+
+// OverflowPolicy describes what happens when events are added to a queue which
+// doesn't have room for them under its QueueLimits
+type OverflowPolicy int
+
+const (
+	// OverflowReject causes the events to not be added, and ErrQueueFull to be
+	// returned
+	OverflowReject OverflowPolicy = iota
+
+	// OverflowDrop causes the oldest events in the queue to be removed from it,
+	// as if by QRem, until there's room for the new ones. The new events are
+	// never the ones removed
+	OverflowDrop
+
+	// OverflowBlock causes the add to wait until there's room for the events,
+	// which is made when events in the queue expire or are removed using QRem,
+	// PurgeQueue or DeleteQueue. If the add's BlockUntil is reached first
+	// ErrQueueFull is returned
+	OverflowBlock
+)
+
+// QueueLimits bound how much a single queue may hold. Every event added to the
+// queue while it has limits counts towards them until it expires or is removed
+// from the queue, including scheduled events and events which consumer groups
+// have already retrieved.
+type QueueLimits struct {
+	// If greater than zero, the maximum number of events the queue may hold
+	MaxLength int64
+
+	// If greater than zero, the maximum total size of the events the queue may
+	// hold, in bytes. An event's size is the length of its Contents plus the
+	// lengths of all its Headers' keys and values.
+	MaxBytes int64
+
+	// What happens when there isn't room for new events. Defaults to
+	// OverflowReject
+	Overflow OverflowPolicy
+}
+
+func (l QueueLimits) bounded() bool {
+	return l.MaxLength > 0 || l.MaxBytes > 0
+}
+
+// returns the number of bytes the event counts for against its queue's
+// MaxBytes. This is never less than one, since a zero score means something
+// else to exWrap
+func eventSize(e core.Event) int64 {
+	size := int64(len(e.Contents))
+	for k, v := range e.Headers {
+		size += int64(len(k) + len(v))
+	}
+	if size < 1 {
+		size = 1
+	}
+	return size
+}
+
+// sizesWrap is an exWrap which also keeps track of the size of each of its
+// events, and the total of those sizes, so that a queue's QueueLimits can be
+// checked without reading every event in it
+type sizesWrap struct {
+	exWrap
+	bySize core.Key
+	total  core.Key
+}
+
+func newSizesWrap(k core.Key) sizesWrap {
+	sw := sizesWrap{exWrap: newExWrap(k)}
+	sw.bySize = k.Copy()
+	sw.bySize.Subs = append(sw.bySize.Subs, "bytes")
+	sw.total = k.Copy()
+	sw.total.Subs = append(sw.total.Subs, "total")
+	return sw
+}
+
+// returns actions which will add the given events, with their IDs' T fields as
+// their scores. The output from these actions will be the events' IDs
+func (sw sizesWrap) addAll(ee []core.Event) []core.QueryAction {
+	ii := make([]core.ID, len(ee))
+	qq := make([]core.QueryAction, 0, len(ee)*2+4)
+	for i, e := range ee {
+		ii[i] = e.ID
+		qq = append(qq,
+			core.QueryAction{
+				QuerySelector: &core.QuerySelector{IDs: ii[i : i+1]},
+			},
+			core.QueryAction{
+				QueryAddTo: &core.QueryAddTo{
+					Keys:  []core.Key{sw.bySize},
+					Score: core.TS(eventSize(e)),
+				},
+			},
+		)
+	}
+	qq = append(qq, sw.exWrap.addAll(ii, 0)...)
+	return append(qq, core.QueryAction{
+		QueryTally: &core.QueryTally{Key: sw.bySize, TotalKey: sw.total},
+	})
+}
+
+// returns actions which will remove the IDs which are input into them, and take
+// their sizes off the total. input is passed straight through to output
+func (sw sizesWrap) removeFromInput() []core.QueryAction {
+	return []core.QueryAction{
+		{
+			QueryTally: &core.QueryTally{
+				Key:      sw.bySize,
+				TotalKey: sw.total,
+				Decr:     true,
+			},
+		},
+		{
+			RemoveFrom: []core.Key{sw.byArb, sw.byExp, sw.bySize},
+		},
+	}
+}
+
+// returns actions which will remove all events whose expire has passed (based
+// on the given TS). The output from these actions will be the events which were
+// removed
+func (sw sizesWrap) removeExpired(now core.TS) []core.QueryAction {
+	qq := []core.QueryAction{{
+		QuerySelector: &core.QuerySelector{
+			Key: sw.byExp,
+			QueryRangeSelect: &core.QueryRangeSelect{
+				QueryScoreRange: core.QueryScoreRange{
+					Max: now,
+				},
+			},
+		},
+	}}
+	return append(qq, sw.removeFromInput()...)
+}
+
+// returns an action which will output the oldest events which would have to be
+// removed for the rest to fit within the given limits. The given events are
+// never output, though they still count towards the limits
+func (sw sizesWrap) excess(l QueueLimits, keep []core.ID) core.QueryAction {
+	return core.QueryAction{
+		QuerySelector: &core.QuerySelector{
+			Key: sw.byArb,
+			QueryExcessSelect: &core.QueryExcessSelect{
+				MaxCount:    l.MaxLength,
+				MaxSum:      l.MaxBytes,
+				SumKey:      sw.bySize,
+				SumTotalKey: sw.total,
+				Keep:        keep,
+			},
+		},
+	}
+}
+
+// limiter enforces a queue's QueueLimits on the events being added to it
+type limiter struct {
+	QueueLimits
+	ewSizes sizesWrap
+
+	// every set apart from ewSizes which events are dropped from
+	ewIDs []exWrap
+}
+
+func (p *Peel) limiter(queue string) (limiter, error) {
+	var l limiter
+	if p.o.Limits != nil {
+		l.QueueLimits = p.o.Limits(queue)
+	}
+	if !l.bounded() {
+		return l, nil
+	}
+
+	var err error
+	if l.ewSizes, err = queueSizes(queue); err != nil {
+		return limiter{}, err
+	}
+
+	for _, priority := range p.priorities() {
+		ewAvail, err := queueAvailable(queue, priority)
+		if err != nil {
+			return limiter{}, err
+		}
+		ewSched, err := queueScheduled(queue, priority)
+		if err != nil {
+			return limiter{}, err
+		}
+		l.ewIDs = append(l.ewIDs, ewAvail, ewSched)
+	}
+	return l, nil
+}
+
+// returns ErrTooLarge if the given events wouldn't fit within the limits even
+// with nothing else in the queue
+func (l limiter) fits(ee []core.Event) error {
+	if l.MaxLength > 0 && int64(len(ee)) > l.MaxLength {
+		return ErrTooLarge
+	}
+	if l.MaxBytes > 0 {
+		var size int64
+		for _, e := range ee {
+			size += eventSize(e)
+		}
+		if size > l.MaxBytes {
+			return ErrTooLarge
+		}
+	}
+	return nil
+}
+
+// wraps qq, which are actions adding the given events to the queue, so that the
+// limits are enforced on them. The events are tracked in the sizes set, and
+// then the other events in the queue which exceed the limits are selected and
+// the number of them is appended to the result's Counts.
+//
+// With OverflowDrop this happens after qq, and the excess events are removed
+// from the queue's available, scheduled and sizes sets. The output is those
+// events along with the given ones, and the excess events must then be passed
+// to remEvents so they're removed from the consumer groups' sets, and deleted.
+// Otherwise it happens before qq, and if there are any excess events the given
+// events are taken back out of the sizes set and the pipeline is stopped, with
+// the given events as its output.
+func (l limiter) wrap(now core.TS, ee []core.Event, qq []core.QueryAction) []core.QueryAction {
+	if !l.bounded() {
+		return qq
+	}
+
+	ii := make([]core.ID, len(ee))
+	for i := range ee {
+		ii[i] = ee[i].ID
+	}
+	qqLimit := l.ewSizes.removeExpired(now)
+	qqLimit = append(qqLimit, l.ewSizes.addAll(ee)...)
+	qqLimit = append(qqLimit,
+		l.ewSizes.excess(l.QueueLimits, ii),
+		core.QueryAction{CountInput: true},
+	)
+
+	if l.Overflow == OverflowDrop {
+		remove := core.QueryAction{}
+		for _, ew := range l.ewIDs {
+			remove.RemoveFrom = append(remove.RemoveFrom, ew.byArb, ew.byExp)
+		}
+		qq = append(qq, qqLimit...)
+		qq = append(qq, l.ewSizes.removeFromInput()...)
+		return append(qq, remove, core.QueryAction{
+			QuerySelector: &core.QuerySelector{IDs: ii},
+			Union:         true,
+		})
+	}
+
+	qqLimit = append(qqLimit,
+		core.QueryAction{
+			QuerySelector: &core.QuerySelector{IDs: ii},
+			QueryConditional: core.QueryConditional{
+				IfInput: true,
+			},
+		},
+	)
+	qqLimit = append(qqLimit, l.ewSizes.removeFromInput()...)
+	qqLimit = append(qqLimit,
+		core.QueryAction{
+			Break: true,
+			QueryConditional: core.QueryConditional{
+				IfInput: true,
+			},
+		},
+	)
+	return append(qqLimit, qq...)
+}
+
+// performs the query returned by mkQuery, whose actions must have been wrapped
+// using wrap. With OverflowBlock the query is performed again, with the current
+// time, whenever room might have been made in the queue, until either there's
+// room for the events, blockUntil is reached (if it's set) or stopCh is closed.
+// ErrQueueFull is returned if there isn't room for the events.
+func (p *Peel) queryLimited(l limiter, blockUntil time.Time, stopCh <-chan struct{}, mkQuery func(core.TS) core.QueryActions) (core.QueryRes, error) {
+	keySpace := l.ewSizes.byArb
+
+	var timeoutCh <-chan time.Time
+	if l.Overflow == OverflowBlock && !blockUntil.IsZero() {
+		timeoutCh = time.After(blockUntil.Sub(time.Now()))
+	}
+
+	for {
+		var waitStopCh chan struct{}
+		var spaceCh <-chan struct{}
+		if l.Overflow == OverflowBlock {
+			waitStopCh = make(chan struct{})
+			spaceCh = p.c.KeyWait(keySpace, waitStopCh)
+		}
+		stopWait := func() {
+			if waitStopCh != nil {
+				close(waitStopCh)
+			}
+		}
+
+		res, err := p.c.Query(mkQuery(core.NewTS(time.Now())))
+		full := err == nil && l.Overflow != OverflowDrop &&
+			len(res.Counts) > 0 && res.Counts[0] > 0
+		if !full {
+			stopWait()
+			return res, err
+		} else if l.Overflow != OverflowBlock {
+			return res, ErrQueueFull
+		}
+
+		// Nothing is pushed when events expire, so wake up for the next one
+		var expireCh <-chan time.Time
+		if next, err := p.nextExpire(l.ewSizes.exWrap); err != nil {
+			stopWait()
+			return res, err
+		} else if !next.IsZero() {
+			expireCh = time.After(next.Sub(time.Now()))
+		}
+
+		select {
+		case <-spaceCh:
+		case <-expireCh:
+		case <-timeoutCh:
+			stopWait()
+			return res, ErrQueueFull
+		case <-stopCh:
+			stopWait()
+			return res, ErrQueueFull
+		}
+		stopWait()
+	}
+}
+
+// returns the time at which the next event in the given set will expire, or the
+// zero time if it's empty
+func (p *Peel) nextExpire(ew exWrap) (time.Time, error) {
+	qa := core.QueryActions{
+		KeyBase: ew.base,
+		QueryActions: []core.QueryAction{{
+			QuerySelector: &core.QuerySelector{
+				Key:            ew.byExp,
+				PosRangeSelect: []int64{0, 0},
+			},
+		}},
+	}
+	res, err := p.c.Query(qa)
+	if err != nil || len(res.IDs) == 0 {
+		return time.Time{}, err
+	}
+	return res.IDs[0].Expire.Time(), nil
+}
@@ -0,0 +1,264 @@
+package peel
+
+import (
+	. "testing"
+	"time"
+
+	"github.com/levenlabs/golib/testutil"
+	"github.com/mediocregopher/bananaq/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newLimitedPeel(lim QueueLimits) *Peel {
+	p := &Peel{c: testPeel.c, o: testPeel.o}
+	p.o.Limits = func(string) QueueLimits { return lim }
+	return p
+}
+
+func TestQueueLimitsReject(t *T) {
+	p := newLimitedPeel(QueueLimits{MaxLength: 2})
+	queue := testutil.RandStr()
+	qadd := func() (core.ID, error) {
+		return p.QAdd(QAddCommand{
+			Queue:    queue,
+			Expire:   time.Now().Add(10 * time.Minute),
+			Contents: testutil.RandStr(),
+		})
+	}
+
+	id1, err := qadd()
+	require.Nil(t, err)
+	id2, err := qadd()
+	require.Nil(t, err)
+	_, err = qadd()
+	assert.Equal(t, ErrQueueFull, err)
+
+	ewAvail, err := queueAvailable(queue, 0)
+	require.Nil(t, err)
+	assertKey(t, ewAvail.byArb, id1, id2)
+
+	// Removing an event makes room for another
+	_, err = p.QRem(QRemCommand{Queue: queue, EventID: id1})
+	require.Nil(t, err)
+	id3, err := qadd()
+	require.Nil(t, err)
+	assertKey(t, ewAvail.byArb, id2, id3)
+
+	// Batches are all or nothing
+	_, err = p.QAddBatch(QAddBatchCommand{
+		Queue:    queue,
+		Expire:   time.Now().Add(10 * time.Minute),
+		Contents: []string{testutil.RandStr()},
+	})
+	assert.Equal(t, ErrQueueFull, err)
+	_, err = p.QAddBatch(QAddBatchCommand{
+		Queue:    queue,
+		Expire:   time.Now().Add(10 * time.Minute),
+		Contents: []string{testutil.RandStr(), testutil.RandStr(), testutil.RandStr()},
+	})
+	assert.Equal(t, ErrTooLarge, err)
+	assertKey(t, ewAvail.byArb, id2, id3)
+
+	// Purging the queue makes room for everything
+	require.Nil(t, p.PurgeQueue(queue))
+	ii, err := p.QAddBatch(QAddBatchCommand{
+		Queue:    queue,
+		Expire:   time.Now().Add(10 * time.Minute),
+		Contents: []string{testutil.RandStr(), testutil.RandStr()},
+	})
+	require.Nil(t, err)
+	assertKey(t, ewAvail.byArb, ii...)
+}
+
+func TestQueueLimitsBytes(t *T) {
+	p := newLimitedPeel(QueueLimits{MaxBytes: 8})
+	queue := testutil.RandStr()
+	qadd := func(contents string, expire time.Duration) (core.ID, error) {
+		return p.QAdd(QAddCommand{
+			Queue:    queue,
+			Expire:   time.Now().Add(expire),
+			Contents: contents,
+		})
+	}
+
+	id1, err := qadd("aaaa", 10*time.Minute)
+	require.Nil(t, err)
+	_, err = qadd("bbbb", 10*time.Minute)
+	require.Nil(t, err)
+	_, err = qadd("c", 10*time.Minute)
+	assert.Equal(t, ErrQueueFull, err)
+
+	// Every way of taking events out of the queue makes room for their bytes
+	_, err = p.QRem(QRemCommand{Queue: queue, EventID: id1})
+	require.Nil(t, err)
+	_, err = qadd("cccc", 10*time.Minute)
+	require.Nil(t, err)
+
+	require.Nil(t, p.PurgeQueue(queue))
+	_, err = qadd("dddd", 500*time.Millisecond)
+	require.Nil(t, err)
+	_, err = qadd("eeee", 10*time.Minute)
+	require.Nil(t, err)
+	_, err = qadd("f", 10*time.Minute)
+	assert.Equal(t, ErrQueueFull, err)
+
+	time.Sleep(1 * time.Second)
+	_, err = qadd("ffff", 10*time.Minute)
+	require.Nil(t, err)
+}
+
+func TestQueueLimitsDrop(t *T) {
+	p := newLimitedPeel(QueueLimits{MaxBytes: 10, Overflow: OverflowDrop})
+	queue := testutil.RandStr()
+	qadd := func(contents string) (core.ID, error) {
+		return p.QAdd(QAddCommand{
+			Queue:    queue,
+			Expire:   time.Now().Add(10 * time.Minute),
+			Contents: contents,
+		})
+	}
+
+	id1, err := qadd("aaaa")
+	require.Nil(t, err)
+	id2, err := qadd("bbbb")
+	require.Nil(t, err)
+	id3, err := qadd("cccc")
+	require.Nil(t, err)
+
+	ewAvail, err := queueAvailable(queue, 0)
+	require.Nil(t, err)
+	assertKey(t, ewAvail.byArb, id2, id3)
+	_, err = p.c.GetEvent(id1)
+	assert.Equal(t, core.ErrNotFound, err)
+
+	// A batch can push out everything else
+	ii, err := p.QAddBatch(QAddBatchCommand{
+		Queue:    queue,
+		Expire:   time.Now().Add(10 * time.Minute),
+		Contents: []string{"ddddd", "eeeee"},
+	})
+	require.Nil(t, err)
+	assertKey(t, ewAvail.byArb, ii...)
+
+	_, err = qadd("fffffffffff")
+	assert.Equal(t, ErrTooLarge, err)
+	assertKey(t, ewAvail.byArb, ii...)
+}
+
+func TestQueueLimitsDropCGroups(t *T) {
+	p := newLimitedPeel(QueueLimits{MaxLength: 1, Overflow: OverflowDrop})
+	queue := testutil.RandStr()
+	cgroup := testutil.RandStr()
+	expire := time.Now().Add(10 * time.Minute)
+
+	ewAvail, err := queueAvailable(queue, 0)
+	require.Nil(t, err)
+	ewSched, err := queueScheduled(queue, 0)
+	require.Nil(t, err)
+	ewInProg, _, _, err := queueCGroupKeys(queue, cgroup, 0)
+	require.Nil(t, err)
+
+	// A scheduled event is newer than anything added now, but it's still the
+	// one dropped to make room for a new event
+	idSched, err := p.QAdd(QAddCommand{
+		Queue:     queue,
+		Expire:    expire,
+		Contents:  testutil.RandStr(),
+		Available: time.Now().Add(5 * time.Minute),
+	})
+	require.Nil(t, err)
+	id1, err := p.QAdd(QAddCommand{Queue: queue, Expire: expire, Contents: testutil.RandStr()})
+	require.Nil(t, err)
+	assertKey(t, ewSched.byArb)
+	assertKey(t, ewAvail.byArb, id1)
+	_, err = p.c.GetEvent(idSched)
+	assert.Equal(t, core.ErrNotFound, err)
+
+	// An event which a consumer group has in progress is taken out of the
+	// group when it's dropped
+	e, err := p.QGet(QGetCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		AckDeadline:   time.Now().Add(1 * time.Minute),
+	})
+	require.Nil(t, err)
+	require.Equal(t, id1, e.ID)
+	assertKey(t, ewInProg.byArb, id1)
+
+	id2, err := p.QAdd(QAddCommand{Queue: queue, Expire: expire, Contents: testutil.RandStr()})
+	require.Nil(t, err)
+	assertKey(t, ewAvail.byArb, id2)
+	assertKey(t, ewInProg.byArb)
+}
+
+func TestQueueLimitsBlock(t *T) {
+	p := newLimitedPeel(QueueLimits{MaxLength: 1, Overflow: OverflowBlock})
+	queue := testutil.RandStr()
+	qadd := func(expire time.Duration, blockUntil time.Time, stopCh chan struct{}) chan error {
+		errCh := make(chan error, 1)
+		go func() {
+			_, err := p.QAdd(QAddCommand{
+				Queue:      queue,
+				Expire:     time.Now().Add(expire),
+				Contents:   testutil.RandStr(),
+				BlockUntil: blockUntil,
+				StopCh:     stopCh,
+			})
+			errCh <- err
+		}()
+		return errCh
+	}
+	assertBlocked := func(errCh chan error) {
+		select {
+		case err := <-errCh:
+			t.Fatalf("QAdd didn't block, returned %v", err)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	assertDone := func(errCh chan error, expected error) {
+		select {
+		case err := <-errCh:
+			assert.Equal(t, expected, err)
+		case <-time.After(2 * time.Second):
+			t.Fatal("QAdd still blocked")
+		}
+	}
+
+	// The blocked add goes through once the first event expires
+	assertDone(qadd(500*time.Millisecond, time.Time{}, nil), nil)
+	errCh := qadd(10*time.Minute, time.Time{}, nil)
+	assertBlocked(errCh)
+	assertDone(errCh, nil)
+
+	// And again once the event is removed
+	ewAvail, err := queueAvailable(queue, 0)
+	require.Nil(t, err)
+	res, err := p.c.Query(core.QueryActions{
+		KeyBase: ewAvail.base,
+		QueryActions: []core.QueryAction{
+			ewAvail.after(0, 0),
+			{QueryFilter: &core.QueryFilter{Expired: true}},
+		},
+	})
+	require.Nil(t, err)
+	require.Len(t, res.IDs, 1)
+
+	errCh = qadd(10*time.Minute, time.Time{}, nil)
+	assertBlocked(errCh)
+	_, err = p.QRem(QRemCommand{Queue: queue, EventID: res.IDs[0]})
+	require.Nil(t, err)
+	assertDone(errCh, nil)
+
+	// Closing StopCh gives up waiting
+	stopCh := make(chan struct{})
+	errCh = qadd(10*time.Minute, time.Time{}, stopCh)
+	assertBlocked(errCh)
+	close(stopCh)
+	assertDone(errCh, ErrQueueFull)
+
+	// As does reaching BlockUntil
+	errCh = qadd(10*time.Minute, time.Now().Add(500*time.Millisecond), nil)
+	assertBlocked(errCh)
+	assertDone(errCh, ErrQueueFull)
+}
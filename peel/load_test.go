@@ -56,7 +56,7 @@ func TestConsumerLoad(t *T) {
 				AckDeadline:   deadline,
 			})
 			require.Nil(t, err)
-			if (e == core.Event{}) {
+			if (e.ID == core.ID{}) {
 				time.Sleep(1 * time.Second)
 				continue
 			}
@@ -106,7 +106,7 @@ func TestConsumerLoad(t *T) {
 		assert.Contains(t, m, id)
 	}
 
-	ewInProg, ewRedo, _, err := queueCGroupKeys(queue, cgroup)
+	ewInProg, ewRedo, _, err := queueCGroupKeys(queue, cgroup, 0)
 	require.Nil(t, err)
 
 	llog.Info("checking inprogress sets")
@@ -5,15 +5,16 @@
 //
 // Initialization and Running
 //
-// A new peel takes in either a *pool.Pool or a *cluster.Cluster from the
-// radix.v2 package, and can be initialized and run like so:
+// A new peel takes in a Backend, which is normally a *core.Core wrapping either
+// a *pool.Pool or a *cluster.Cluster from the radix.v2 package, and can be
+// initialized and run like so:
 //
 // 	rpool, err := pool.New("tcp", "127.0.0.1:6379", 10)
 //	if err != nil {
 //		panic(err)
 //	}
 //
-//	p := &peel.Peel{Cmder: rpool}
+//	p := peel.New(core.New(rpool, nil), nil)
 //	for {
 //  	errCh := p.Run(nil)
 //		err := <-errCh // block until error is hit
@@ -39,47 +40,86 @@
 package peel
 
 import (
+	"errors"
 	"fmt"
+	"sort"
 	"strconv"
 	"time"
 
 	"github.com/mediocregopher/bananaq/core"
-	"github.com/mediocregopher/radix.v2/util"
 )
 
 // Opts are extra configuration fields which may be set on Peel
 type Opts struct {
-	core.Opts
-
 	// Default 1 minute. Period of time to wait between automatic cleaning of
 	// all queues/consumer groups.
 	CleanPeriod time.Duration
+
+	// Default 0 (unlimited). The number of times an event may be retrieved by
+	// a consumer group with an AckDeadline before it will no longer be redone.
+	// Once an event has been retrieved this many times and still isn't
+	// acknowledged, it is moved into the consumer group's dead set instead of
+	// its redo set, and is never handed out to that consumer group again.
+	MaxDeliveries int
+
+	// Default 1. The number of priority levels events may be added to a queue
+	// with. Valid priorities go from 0 (the lowest) up to PriorityLevels-1 (the
+	// highest).
+	PriorityLevels int
+
+	// Default 5 minutes. How long after an event is added with a DedupKey that
+	// further events added to the same queue with the same DedupKey will be
+	// considered duplicates of it.
+	DedupWindow time.Duration
+
+	// Default 24 hours. How long after a named consumer last retrieved events
+	// that it will be forgotten, and no longer returned from QConsumers.
+	ConsumerExpire time.Duration
+
+	// Optional. Returns the limits on how much the given queue may hold, which
+	// are enforced whenever events are added to it. If nil, or if neither
+	// MaxLength nor MaxBytes are set in the return, the queue only shrinks as
+	// its events expire. See QueueLimits.
+	Limits func(queue string) QueueLimits
 }
 
+// ErrInvalidPriority is returned when adding events with a priority which is
+// not valid given the PriorityLevels in Opts
+var ErrInvalidPriority = errors.New("invalid priority")
+
 // Peel contains all the information needed to actually implement the
 // application logic of bananaq. it is intended to be used both as the server
 // component and as a client for external applications which want to be able to
 // interact with the database directly. All methods on Peel are thread-safe,
 // except Run which should only be run by a single goroutine at a time.
 type Peel struct {
-	c *core.Core
+	c Backend
 	o Opts
 }
 
 // TODO make methods take in a now parameter
 
-// New initializes a new Peel instance based on the given Cmder (which may be a
-// *pool.Pool or *cluster.Cluster) and extra options (which may be nil). Run
-// must be called in order to actually use the Peel.
-func New(cmder util.Cmder, o *Opts) *Peel {
+// New initializes a new Peel instance based on the given Backend and extra
+// options (which may be nil). Run must be called in order to actually use the
+// Peel, and will take care of running the Backend as well.
+func New(b Backend, o *Opts) *Peel {
 	if o == nil {
 		o = &Opts{}
 	}
 	if o.CleanPeriod == 0 {
 		o.CleanPeriod = 1 * time.Minute
 	}
+	if o.PriorityLevels < 1 {
+		o.PriorityLevels = 1
+	}
+	if o.DedupWindow == 0 {
+		o.DedupWindow = 5 * time.Minute
+	}
+	if o.ConsumerExpire == 0 {
+		o.ConsumerExpire = 24 * time.Hour
+	}
 	return &Peel{
-		c: core.New(cmder, &o.Opts),
+		c: b,
 		o: *o,
 	}
 }
@@ -120,6 +160,7 @@ func (p *Peel) Run(stopCh chan struct{}) chan error {
 			case err = <-coreErrCh:
 				return
 			case <-stopCh:
+				return
 			}
 		}
 	}()
@@ -127,48 +168,301 @@ func (p *Peel) Run(stopCh chan struct{}) chan error {
 	return errCh
 }
 
+// returns all valid priority levels, from highest to lowest
+func (p *Peel) priorities() []int {
+	pp := make([]int, p.o.PriorityLevels)
+	for i := range pp {
+		pp[i] = p.o.PriorityLevels - 1 - i
+	}
+	return pp
+}
+
+func (p *Peel) validPriority(priority int) bool {
+	return priority >= 0 && priority < p.o.PriorityLevels
+}
+
+// We always store the event data itself with an extra 30 seconds until it
+// expires, just in case a consumer gets it just as its expire time hits
+const eventExpireBuffer = 30 * time.Second
+
 // QAddCommand describes the parameters which can be passed into the QAdd
 // command
 type QAddCommand struct {
 	Queue    string    // Required
 	Expire   time.Time // Required
 	Contents string    // Required
+
+	// If set to a time in the future, the event will not be available to any
+	// consumer group until then
+	Available time.Time
+
+	// Defaults to 0, the lowest priority. See Opts.PriorityLevels
+	Priority int
+
+	// Optional metadata to store alongside Contents
+	Headers map[string]string
+
+	// Optional. If an event was added to the queue with the same DedupKey
+	// within the last Opts.DedupWindow, and it hasn't expired, no new event is
+	// added and the ID of that original event is returned instead
+	DedupKey string
+
+	// Optional, only used if the queue's QueueLimits have an Overflow of
+	// OverflowBlock. If there still isn't room in the queue once BlockUntil is
+	// reached, or StopCh is closed while waiting for room, the call will return
+	// ErrQueueFull. If BlockUntil isn't set the call waits until there's room
+	// or StopCh is closed
+	BlockUntil time.Time
+	StopCh     <-chan struct{}
 }
 
 // QAdd adds an event to a queue. Once Expire is reached the event will no
 // longer be considered valid in the queue, and will eventually be cleaned up.
+//
+// If Available is set the returned ID will correspond to that time, rather than
+// the current time, so that the event is ordered in the queue as if it had been
+// added when it became available.
+//
+// If DedupKey is set and the event is found to be a duplicate, the returned ID
+// will be the original event's.
+//
+// If the queue has QueueLimits and there isn't room for the event, what
+// happens depends on their Overflow. ErrTooLarge is returned if the event would
+// never fit.
 func (p *Peel) QAdd(c QAddCommand) (core.ID, error) {
-	now := core.NewTS(time.Now())
-	e, err := p.c.NewEvent(now, core.NewTS(c.Expire), c.Contents)
+	if !p.validPriority(c.Priority) {
+		return core.ID{}, ErrInvalidPriority
+	}
+
+	ew, err := queueAvailable(c.Queue, c.Priority)
 	if err != nil {
 		return core.ID{}, err
 	}
 
-	// We always store the event data itself with an extra 30 seconds until it
-	// expires, just in case a consumer gets it just as its expire time hits
-	if err = p.c.SetEvent(e, 30*time.Second); err != nil {
+	keyNotify, err := queueNotify(c.Queue)
+	if err != nil {
 		return core.ID{}, err
 	}
 
-	ewAvail, err := queueAvailable(c.Queue)
+	lim, err := p.limiter(c.Queue)
 	if err != nil {
 		return core.ID{}, err
 	}
 
-	qa := core.QueryActions{
-		KeyBase:      ewAvail.base,
-		QueryActions: ewAvail.add(e.ID, e.ID.T),
-		Now:          now,
+	now := core.NewTS(time.Now())
+	var e core.Event
+	if available := core.NewTS(c.Available); !c.Available.IsZero() && available > now {
+		if ew, err = queueScheduled(c.Queue, c.Priority); err != nil {
+			return core.ID{}, err
+		}
+		e, err = p.c.NewScheduledEvent(available, core.NewTS(c.Expire), c.Contents)
+	} else {
+		e, err = p.c.NewEvent(now, core.NewTS(c.Expire), c.Contents)
 	}
-	if _, err := p.c.Query(qa); err != nil {
+	if err != nil {
 		return core.ID{}, err
 	}
+	e.Headers = c.Headers
 
-	p.c.KeyNotify(ewAvail.byArb)
+	if err = lim.fits([]core.Event{e}); err != nil {
+		return core.ID{}, err
+	}
+
+	if err = p.c.SetEvent(e, eventExpireBuffer); err != nil {
+		return core.ID{}, err
+	}
+
+	var keyDedup core.Key
+	if c.DedupKey != "" {
+		if keyDedup, err = queueDedup(c.Queue, c.DedupKey); err != nil {
+			return core.ID{}, err
+		}
+	}
+
+	mkQuery := func(now core.TS) core.QueryActions {
+		var qq []core.QueryAction
+		qqAdd := ew.add(e.ID, e.ID.T)
+		if c.DedupKey != "" {
+			// If there's already an event for the dedup key output it and
+			// stop, otherwise add the new event and remember it under the
+			// dedup key
+			qq = []core.QueryAction{
+				{SingleGet: &keyDedup},
+				{
+					Break: true,
+					QueryConditional: core.QueryConditional{
+						IfInput: true,
+					},
+				},
+			}
+			qqAdd = append(qqAdd, core.QueryAction{
+				QuerySingleSet: &core.QuerySingleSet{
+					Key:      keyDedup,
+					ExpireAt: core.NewTS(now.Time().Add(p.o.DedupWindow)),
+				},
+			})
+		}
+		qq = append(qq, lim.wrap(now, []core.Event{e}, qqAdd)...)
+
+		return core.QueryActions{
+			KeyBase:      ew.base,
+			QueryActions: qq,
+			Now:          now,
+		}
+	}
+
+	res, err := p.queryLimited(lim, c.BlockUntil, c.StopCh, mkQuery)
+	if err == ErrQueueFull {
+		// The event was never added, so the copy which was just stored is
+		// never going to be referenced
+		if err := p.c.DelEvents([]core.ID{e.ID}); err != nil {
+			return core.ID{}, err
+		}
+		return core.ID{}, ErrQueueFull
+	} else if err != nil {
+		return core.ID{}, err
+	}
+
+	var added bool
+	var dropped []core.ID
+	for _, id := range res.IDs {
+		if id == e.ID {
+			added = true
+		} else {
+			dropped = append(dropped, id)
+		}
+	}
+
+	if !added {
+		// The event is a duplicate, so the copy which was just stored is
+		// never going to be referenced
+		if err := p.c.DelEvents([]core.ID{e.ID}); err != nil {
+			return core.ID{}, err
+		}
+		return res.IDs[0], nil
+	}
+
+	// Any other output is events which were dropped to make room for this one.
+	// They've already been taken out of the queue's own sets, so they're
+	// deleted whether or not any consumer group still had them
+	if _, err := p.remEvents(c.Queue, dropped); err != nil {
+		return core.ID{}, err
+	} else if err := p.c.DelEvents(dropped); err != nil {
+		return core.ID{}, err
+	}
+
+	// Even if the event was scheduled, consumers blocking on the queue are
+	// woken up so they know when to expect it
+	p.c.KeyNotify(keyNotify)
 
 	return e.ID, nil
 }
 
+// QAddBatchCommand describes the parameters which can be passed into the
+// QAddBatch command
+type QAddBatchCommand struct {
+	Queue    string    // Required
+	Expire   time.Time // Required
+	Contents []string  // Required
+
+	// Defaults to 0, the lowest priority. See Opts.PriorityLevels
+	Priority int
+
+	// Optional metadata to store alongside each of the Contents
+	Headers map[string]string
+
+	// See QAddCommand
+	BlockUntil time.Time
+	StopCh     <-chan struct{}
+}
+
+// QAddBatch is like QAdd, but adds one event to the queue for each of the given
+// Contents, all sharing the same Expire, Priority and Headers. The returned IDs are in
+// the same order as Contents. The number of round-trips made is the same no
+// matter how many events are being added.
+//
+// QueueLimits are enforced on all the events together, so with OverflowReject
+// or OverflowBlock either all of them are added or none are.
+func (p *Peel) QAddBatch(c QAddBatchCommand) ([]core.ID, error) {
+	if !p.validPriority(c.Priority) {
+		return nil, ErrInvalidPriority
+	} else if len(c.Contents) == 0 {
+		return []core.ID{}, nil
+	}
+
+	now := core.NewTS(time.Now())
+	ee, err := p.c.NewEvents(now, core.NewTS(c.Expire), c.Contents)
+	if err != nil {
+		return nil, err
+	}
+	for i := range ee {
+		ee[i].Headers = c.Headers
+	}
+
+	ewAvail, err := queueAvailable(c.Queue, c.Priority)
+	if err != nil {
+		return nil, err
+	}
+
+	keyNotify, err := queueNotify(c.Queue)
+	if err != nil {
+		return nil, err
+	}
+
+	lim, err := p.limiter(c.Queue)
+	if err != nil {
+		return nil, err
+	} else if err = lim.fits(ee); err != nil {
+		return nil, err
+	}
+
+	if err = p.c.SetEvents(ee, eventExpireBuffer); err != nil {
+		return nil, err
+	}
+
+	ii := make([]core.ID, len(ee))
+	added := map[core.ID]bool{}
+	for i := range ee {
+		ii[i] = ee[i].ID
+		added[ii[i]] = true
+	}
+
+	mkQuery := func(now core.TS) core.QueryActions {
+		return core.QueryActions{
+			KeyBase:      ewAvail.base,
+			QueryActions: lim.wrap(now, ee, ewAvail.addAll(ii, 0)),
+			Now:          now,
+		}
+	}
+
+	res, err := p.queryLimited(lim, c.BlockUntil, c.StopCh, mkQuery)
+	if err == ErrQueueFull {
+		if err := p.c.DelEvents(ii); err != nil {
+			return nil, err
+		}
+		return nil, ErrQueueFull
+	} else if err != nil {
+		return nil, err
+	}
+
+	// Any output which isn't one of the new events was dropped to make room
+	var dropped []core.ID
+	for _, id := range res.IDs {
+		if !added[id] {
+			dropped = append(dropped, id)
+		}
+	}
+	if _, err := p.remEvents(c.Queue, dropped); err != nil {
+		return nil, err
+	} else if err := p.c.DelEvents(dropped); err != nil {
+		return nil, err
+	}
+
+	p.c.KeyNotify(keyNotify)
+
+	return ii, nil
+}
+
 // QGetCommand describes the parameters which can be passed into the QGet
 // command
 type QGetCommand struct {
@@ -176,10 +470,25 @@ type QGetCommand struct {
 	ConsumerGroup string // Required
 	AckDeadline   time.Time
 	BlockUntil    time.Time
+
+	// Optional, only used if BlockUntil is set. If closed while blocking the
+	// call will return immediately, as if BlockUntil had been reached
+	StopCh <-chan struct{}
+
+	// Only used by QGetBatch. The maximum number of events to retrieve,
+	// defaults to 1
+	Count int
+
+	// Optional. The name of the consumer within the consumer group which is
+	// retrieving events. If set, the consumer is recorded as having been seen,
+	// and it's recorded as holding the events retrieved if AckDeadline is also
+	// set, so that only it may QAck them. See QConsumers.
+	Consumer string
 }
 
 // QGet retrieves an available event from the given queue for the given consumer
-// group.
+// group. Events with a higher priority are always retrieved before any with a
+// lower priority.
 //
 // If AckDeadline is given, then the consumer has until then to QAck the
 // Event before it is placed back in the queue for this consumer group. If
@@ -188,13 +497,35 @@ type QGetCommand struct {
 //
 // An empty event is returned if there are no available events for the queue.
 func (p *Peel) QGet(c QGetCommand) (core.Event, error) {
+	c.Count = 1
+	ee, err := p.QGetBatch(c)
+	if err != nil || len(ee) == 0 {
+		return core.Event{}, err
+	}
+	return ee[0], nil
+}
+
+// QGetBatch is like QGet, but retrieves up to Count events at once, all of them
+// sharing the same AckDeadline. All returned events are from the highest
+// priority level which has any available. Within that level events which are
+// being redone are returned first, followed by events from the queue in the
+// order they were added.
+//
+// An empty slice is returned if there are no available events for the queue.
+// If BlockUntil is set this will return as soon as any events are available,
+// even if there are less than Count of them.
+func (p *Peel) QGetBatch(c QGetCommand) ([]core.Event, error) {
+	if c.Count < 1 {
+		c.Count = 1
+	}
+
 	if c.BlockUntil.IsZero() {
 		return p.qgetDirect(c)
 	}
 
-	ewAvail, err := queueAvailable(c.Queue)
+	keyNotify, err := queueNotify(c.Queue)
 	if err != nil {
-		return core.Event{}, err
+		return nil, err
 	}
 
 	now := time.Now()
@@ -202,101 +533,298 @@ func (p *Peel) QGet(c QGetCommand) (core.Event, error) {
 
 	for {
 		stopCh := make(chan struct{})
-		pushCh := p.c.KeyWait(ewAvail.byArb, stopCh)
+		pushCh := p.c.KeyWait(keyNotify, stopCh)
 
-		if e, err := p.qgetDirect(c); err != nil || (e != core.Event{}) {
-			return e, err
+		if ee, err := p.qgetDirect(c); err != nil || len(ee) > 0 {
+			return ee, err
+		}
+
+		// If a scheduled event is going to become available we need to wake
+		// up for it, since nothing will be pushed when it does
+		var dueCh <-chan time.Time
+		if due, err := p.nextScheduled(c.Queue); err != nil {
+			return nil, err
+		} else if !due.IsZero() {
+			dueCh = time.After(due.Sub(time.Now()))
 		}
 
 		select {
 		case <-pushCh:
+		case <-dueCh:
 		case <-timeoutCh:
-			return core.Event{}, nil
+			close(stopCh)
+			return []core.Event{}, nil
+		case <-c.StopCh:
+			close(stopCh)
+			return []core.Event{}, nil
 		}
 
 		close(stopCh)
 	}
 }
 
-func (p *Peel) qgetDirect(c QGetCommand) (core.Event, error) {
-	ewAvail, err := queueAvailable(c.Queue)
-	if err != nil {
-		return core.Event{}, err
-	}
+// returns actions which will move all events in the queue's scheduled set which
+// have become available into its available set
+func promoteScheduled(now core.TS, ewSched, ewAvail exWrap) []core.QueryAction {
+	var qq []core.QueryAction
+	qq = append(qq, ewSched.removeExpired(now)...)
+	qq = append(qq, core.QueryAction{
+		QuerySelector: &core.QuerySelector{
+			Key: ewSched.byArb,
+			QueryRangeSelect: &core.QueryRangeSelect{
+				QueryScoreRange: core.QueryScoreRange{
+					Max: now,
+				},
+			},
+		},
+	})
+	qq = append(qq, ewSched.removeFromInput())
+	qq = append(qq, ewAvail.addFromInput(0)...)
+	return qq
+}
 
-	ewInProg, ewRedo, keyPtr, err := queueCGroupKeys(c.Queue, c.ConsumerGroup)
-	if err != nil {
-		return core.Event{}, err
+// returns the time at which the next scheduled event in the queue will become
+// available, or the zero time if there aren't any
+func (p *Peel) nextScheduled(queue string) (time.Time, error) {
+	var ewSched exWrap
+	var qq []core.QueryAction
+	for _, priority := range p.priorities() {
+		var err error
+		if ewSched, err = queueScheduled(queue, priority); err != nil {
+			return time.Time{}, err
+		}
+		qq = append(qq, core.QueryAction{
+			QuerySelector: &core.QuerySelector{
+				Key:            ewSched.byArb,
+				PosRangeSelect: []int64{0, 0},
+			},
+			Union: true,
+		})
 	}
 
-	now := core.NewTS(time.Now())
+	qa := core.QueryActions{
+		KeyBase:      ewSched.base,
+		QueryActions: qq,
+	}
+	res, err := p.c.Query(qa)
+	if err != nil || len(res.IDs) == 0 {
+		return time.Time{}, err
+	}
+	return res.IDs[0].T.Time(), nil
+}
 
-	// Depending on if Expire is set, we might add the event to the inProg in
-	// addition to setting ptr
-	maybeDone := make([]core.QueryAction, 0, 3)
-	maybeDone = append(maybeDone, core.QueryAction{
-		QuerySingleSet: &core.QuerySingleSet{
-			Key:     keyPtr,
-			IfNewer: true,
-		},
-	})
+func (p *Peel) qgetDirect(c QGetCommand) ([]core.Event, error) {
+	var ewDeliv, ewOwners exWrap
 	if !c.AckDeadline.IsZero() {
-		addToInProg := ewInProg.addFromInput(core.NewTS(c.AckDeadline))
-		maybeDone = append(maybeDone, addToInProg...)
+		var err error
+		if ewDeliv, err = queueDeliveries(c.Queue, c.ConsumerGroup); err != nil {
+			return nil, err
+		}
+		if ewOwners, err = queueOwners(c.Queue, c.ConsumerGroup); err != nil {
+			return nil, err
+		}
+	}
+
+	// If there's a consumer then it's marked as seen
+	var score core.TS
+	if c.Consumer != "" {
+		var err error
+		if score, err = p.consumerScore(c.Queue, c.ConsumerGroup, c.Consumer, true); err != nil {
+			return nil, err
+		}
 	}
-	maybeDone = append(maybeDone, core.QueryAction{
-		Break: true,
-		QueryConditional: core.QueryConditional{
-			IfInput: true,
-		},
-	})
 
+	now := core.NewTS(time.Now())
+	count := int64(c.Count)
+
+	var base string
 	var qq []core.QueryAction
 
-	// First, if there's any IDs in redo, we try to grab the first one from
-	// there
-	qq = append(qq, ewRedo.removeExpired(now)...)
-	qq = append(qq, ewRedo.after(0, 1))
-	qq = append(qq, ewRedo.removeFromInput())
-	qq = append(qq, maybeDone...)
-
-	// Otherwise grab the next event from avail after our pointer. Gotta clean
-	// avail first though. If we get an event, set our pointer and return
-	qq = append(qq, ewAvail.removeExpired(now)...)
-	qq = append(qq,
-		core.QueryAction{
-			SingleGet: &keyPtr,
-		},
-		ewAvail.afterInput(1),
-	)
-	qq = append(qq, maybeDone...)
+	for i, priority := range p.priorities() {
+		ewAvail, err := queueAvailable(c.Queue, priority)
+		if err != nil {
+			return nil, err
+		}
 
-	// The queue has no activity, simply get the first event in avail. Only
-	// applies if our pointer is actually empty. If it's not and we're here it
-	// means that the queue has simply been fully processed thusfar
-	qq = append(qq, core.QueryAction{
-		Break: true,
-		QueryConditional: core.QueryConditional{
-			IfNotEmpty: &keyPtr,
-		},
-	})
-	qq = append(qq, ewAvail.after(0, 1))
-	qq = append(qq, maybeDone...)
+		ewSched, err := queueScheduled(c.Queue, priority)
+		if err != nil {
+			return nil, err
+		}
+
+		ewInProg, ewRedo, keyPtr, err := queueCGroupKeys(c.Queue, c.ConsumerGroup, priority)
+		if err != nil {
+			return nil, err
+		}
+		base = ewAvail.base
+
+		// If a higher priority level had any events for us then that's what
+		// we're returning, and the lower priority levels are left alone
+		if i > 0 {
+			qq = append(qq, core.QueryAction{
+				Break: true,
+				QueryConditional: core.QueryConditional{
+					IfInput: true,
+				},
+			})
+		}
+
+		// First clean out expired events from redo and avail, so we don't
+		// return any of them, and make any scheduled events which are due
+		// available
+		qq = append(qq, ewRedo.removeExpired(now)...)
+		qq = append(qq, ewAvail.removeExpired(now)...)
+		qq = append(qq, promoteScheduled(now, ewSched, ewAvail)...)
+
+		// Grab the next events from avail after our pointer. If the pointer
+		// isn't set then this will start from the very first event in avail
+		qq = append(qq,
+			core.QueryAction{
+				SingleGet: &keyPtr,
+			},
+			ewAvail.afterInput(count),
+		)
+
+		// Merge in the first events from redo. Everything in redo was at some
+		// point retrieved from avail already, so they are all older than
+		// anything after our pointer. Since the output is always sorted,
+		// limiting the merged set to count means that redo events get returned
+		// first.
+		redoAfter := ewRedo.after(0, count)
+		redoAfter.Union = true
+		qq = append(qq, redoAfter, core.QueryAction{LimitInput: count})
+
+		// Whatever's left is what we're returning. Take it out of redo (if
+		// it's in there) and move our pointer up to the newest event we've
+		// gotten
+		qq = append(qq, ewRedo.removeFromInput(), core.QueryAction{
+			QuerySingleSet: &core.QuerySingleSet{
+				Key:     keyPtr,
+				IfNewer: true,
+				Newest:  true,
+			},
+		})
+
+		// If AckDeadline is set the events are also added to inProg, and their
+		// delivery counts are incremented. They now belong to this consumer,
+		// or to no consumer in particular, regardless of who had them before
+		if !c.AckDeadline.IsZero() {
+			qq = append(qq, ewInProg.addFromInput(core.NewTS(c.AckDeadline))...)
+			qq = append(qq, ewDeliv.incrFromInput()...)
+			if score > 0 {
+				qq = append(qq, ewOwners.addFromInput(score)...)
+			} else {
+				qq = append(qq, ewOwners.removeFromInput())
+			}
+		}
+	}
 
 	qa := core.QueryActions{
-		KeyBase:      ewAvail.base,
+		KeyBase:      base,
 		QueryActions: qq,
 		Now:          now,
 	}
 
 	res, err := p.c.Query(qa)
 	if err != nil {
-		return core.Event{}, err
-	} else if len(res.IDs) == 0 {
-		return core.Event{}, nil
+		return nil, err
+	}
+
+	return p.c.GetEvents(res.IDs)
+}
+
+// QPeekCommand describes the parameters which can be passed into the QPeek
+// command
+type QPeekCommand struct {
+	Queue         string // Required
+	ConsumerGroup string // Required
+
+	// The maximum number of events to return, defaults to 1
+	Count int
+}
+
+// QPeek returns the events which the given consumer group would retrieve next
+// from the queue, without actually retrieving them. Nothing about the queue or
+// the consumer group is changed. Events are returned in the order they would be
+// retrieved, highest priority first, with events being redone coming first
+// within each priority level.
+//
+// Fewer than Count events may be returned if some of the upcoming events have
+// expired but not been cleaned up yet.
+func (p *Peel) QPeek(c QPeekCommand) ([]core.Event, error) {
+	if c.Count < 1 {
+		c.Count = 1
+	}
+
+	now := core.NewTS(time.Now())
+	var ii []core.ID
+	for _, priority := range p.priorities() {
+		count := int64(c.Count - len(ii))
+		if count <= 0 {
+			break
+		}
+
+		ewAvail, err := queueAvailable(c.Queue, priority)
+		if err != nil {
+			return nil, err
+		}
+
+		ewSched, err := queueScheduled(c.Queue, priority)
+		if err != nil {
+			return nil, err
+		}
+
+		_, ewRedo, keyPtr, err := queueCGroupKeys(c.Queue, c.ConsumerGroup, priority)
+		if err != nil {
+			return nil, err
+		}
+
+		// This mirrors what qgetDirect does, except that due scheduled events
+		// are merged in rather than being moved into avail, and expired events
+		// are filtered out rather than being removed
+		sched := core.QueryAction{
+			QuerySelector: &core.QuerySelector{
+				Key: ewSched.byArb,
+				QueryRangeSelect: &core.QueryRangeSelect{
+					QueryScoreRange: core.QueryScoreRange{
+						Max: now,
+					},
+					Limit: count,
+				},
+			},
+			Union: true,
+		}
+		redoAfter := ewRedo.after(0, count)
+		redoAfter.Union = true
+
+		qa := core.QueryActions{
+			KeyBase: ewAvail.base,
+			QueryActions: []core.QueryAction{
+				{
+					SingleGet: &keyPtr,
+				},
+				ewAvail.afterInput(count),
+				sched,
+				redoAfter,
+				{
+					QueryFilter: &core.QueryFilter{
+						Expired: true,
+					},
+				},
+				{
+					LimitInput: count,
+				},
+			},
+			Now: now,
+		}
+
+		res, err := p.c.Query(qa)
+		if err != nil {
+			return nil, err
+		}
+		ii = append(ii, res.IDs...)
 	}
 
-	return p.c.GetEvent(res.IDs[0])
+	return p.c.GetEvents(ii)
 }
 
 // QAckCommand describes the parameters which can be passed into the QAck
@@ -305,6 +833,29 @@ type QAckCommand struct {
 	Queue         string  // Required
 	ConsumerGroup string  // Required
 	EventID       core.ID // Required
+
+	// Optional. The name of the consumer acknowledging the event, see the
+	// Consumer field on QGetCommand
+	Consumer string
+
+	// If set the event is acknowledged even if it's held by a consumer other
+	// than Consumer
+	Force bool
+}
+
+// NotOwnerError is returned from QAck, QNack and QExtend when the event is held
+// by a consumer other than the one acting on it
+type NotOwnerError struct {
+	// The name of the consumer holding the event. May be empty if the consumer
+	// has expired
+	Owner string
+}
+
+func (err NotOwnerError) Error() string {
+	if err.Owner == "" {
+		return "event is held by another consumer"
+	}
+	return fmt.Sprintf("event is held by consumer %q", err.Owner)
 }
 
 // QAck acknowledges that an event has been successfully processed and should
@@ -312,87 +863,782 @@ type QAckCommand struct {
 // QGet with an AckDeadline. Returns true if the Event was successfully
 // acknowledged. false will be returned if the deadline was missed, and
 // therefore some other consumer may re-process the Event later.
+//
+// If the event was retrieved by a QGet with a Consumer set, then only that
+// consumer may acknowledge it, unless Force is set. Otherwise a NotOwnerError
+// is returned and the event is left in progress.
 func (p *Peel) QAck(c QAckCommand) (bool, error) {
 	now := core.NewTS(time.Now())
 
-	ewInProg, err := queueInProgress(c.Queue, c.ConsumerGroup)
+	ewDeliv, err := queueDeliveries(c.Queue, c.ConsumerGroup)
 	if err != nil {
 		return false, err
 	}
 
-	var qq []core.QueryAction
-	qq = append(qq, ewInProg.removeExpired(now)...)
-	qq = append(qq, core.QueryAction{
-		QuerySelector: &core.QuerySelector{
-			Key: ewInProg.byArb,
-			QueryIDScoreSelect: &core.QueryIDScoreSelect{
-				ID:  c.EventID,
-				Min: now,
-			},
-		},
-	})
-	qq = append(qq, ewInProg.removeFromInput())
-
-	qa := core.QueryActions{
-		KeyBase:      ewInProg.base,
-		QueryActions: qq,
-		Now:          now,
-	}
-
-	res, err := p.c.Query(qa)
+	ewOwners, err := queueOwners(c.Queue, c.ConsumerGroup)
 	if err != nil {
 		return false, err
 	}
-	return len(res.IDs) > 0, nil
-}
 
-// Clean finds all the events which were retrieved for the given
-// queue/consumerGroup which weren't ack'd by the deadline, and makes them
-// available to be retrieved again.
-func (p *Peel) Clean(queue, consumerGroup string) error {
-	now := core.NewTS(time.Now())
+	// The event could be in progress at any priority level, so check all of
+	// them and remove it from wherever it is
+	var qq, qqSel []core.QueryAction
+	remove := core.QueryAction{
+		RemoveFrom: []core.Key{ewDeliv.byArb, ewDeliv.byExp, ewOwners.byArb, ewOwners.byExp},
+	}
+	for _, priority := range p.priorities() {
+		ewInProg, err := queueInProgress(c.Queue, c.ConsumerGroup, priority)
+		if err != nil {
+			return false, err
+		}
+
+		qq = append(qq, ewInProg.removeExpired(now)...)
+		sel := ewInProg.selectID(c.EventID, now)
+		sel.Union = len(qqSel) > 0
+		qqSel = append(qqSel, sel)
+		remove.RemoveFrom = append(remove.RemoveFrom, ewInProg.byArb, ewInProg.byExp)
+	}
+	qq = append(qq, qqSel...)
+
+	// Unless forced, the event is only let through if the consumer may act on
+	// it. The count from before filtering tells whether it was in progress at
+	// all
+	if !c.Force {
+		qqOwner, err := p.ownerFilter(c.Queue, c.ConsumerGroup, c.Consumer)
+		if err != nil {
+			return false, err
+		}
+		qq = append(qq, core.QueryAction{CountInput: true})
+		qq = append(qq, qqOwner...)
+	}
+	qq = append(qq, remove)
 
-	ewAvail, err := queueAvailable(queue)
+	qa := core.QueryActions{
+		KeyBase:      ewDeliv.base,
+		QueryActions: qq,
+		Now:          now,
+	}
+
+	res, err := p.c.Query(qa)
 	if err != nil {
-		return err
+		return false, err
+	} else if len(res.IDs) > 0 {
+		return true, nil
+	} else if c.Force || res.Counts[0] == 0 {
+		return false, nil
 	}
+	return false, p.notOwnerErr(c.Queue, c.ConsumerGroup, c.EventID)
+}
 
-	// This is a giant hack. But this is literally the only case where we don't
-	// want to exclude the right side afaik, and we *have* to include it no
-	// matter what, so it seemed weird to add a new method or a parameter to an
-	// existing method. Don't do this again.
-	beforeAvail := ewAvail.beforeInput(1)
-	beforeAvail.QuerySelector.QueryRangeSelect.QueryScoreRange.MaxExcl = false
+// returns actions which filter their input down to the events the named
+// consumer may act on, i.e. those which aren't held by any consumer and those
+// which are held by it. If consumer is empty only the former are let through
+func (p *Peel) ownerFilter(queue, cgroup, consumer string) ([]core.QueryAction, error) {
+	ewOwners, err := queueOwners(queue, cgroup)
+	if err != nil {
+		return nil, err
+	}
 
-	ewInProg, ewRedo, keyPtr, err := queueCGroupKeys(queue, consumerGroup)
+	var score core.TS
+	if consumer != "" {
+		if score, err = p.consumerScore(queue, cgroup, consumer, false); err != nil {
+			return nil, err
+		}
+	}
+
+	// A consumer without a score can't hold anything, so anything in owners is
+	// held by someone else. Otherwise anything in owners with another score is.
+	if score == 0 {
+		return []core.QueryAction{{
+			QueryFilter: &core.QueryFilter{InKey: &ewOwners.byArb},
+		}}, nil
+	}
+	return []core.QueryAction{
+		{
+			QueryFilter: &core.QueryFilter{
+				InKey: &ewOwners.byArb,
+				ScoreRange: core.QueryScoreRange{
+					Max:     score,
+					MaxExcl: true,
+				},
+			},
+		},
+		{
+			QueryFilter: &core.QueryFilter{
+				InKey: &ewOwners.byArb,
+				ScoreRange: core.QueryScoreRange{
+					Min:     score,
+					MinExcl: true,
+				},
+			},
+		},
+	}, nil
+}
+
+// returns the NotOwnerError for the given event, which a consumer wasn't
+// allowed to act on
+func (p *Peel) notOwnerErr(queue, cgroup string, id core.ID) error {
+	owner, err := p.eventOwner(queue, cgroup, id)
 	if err != nil {
 		return err
 	}
+	return NotOwnerError{Owner: owner}
+}
+
+// returns the name of the consumer who holds the given event according to the
+// owners set, or empty string if it's not held by any known consumer
+func (p *Peel) eventOwner(queue, cgroup string, id core.ID) (string, error) {
+	consumers, err := p.queueConsumers(queue, cgroup)
+	if err != nil {
+		return "", err
+	}
+
+	ewOwners, err := queueOwners(queue, cgroup)
+	if err != nil {
+		return "", err
+	}
+
+	// Appends a count for each consumer, which will be 1 for the owner and 0
+	// for everyone else
+	var qq []core.QueryAction
+	var qqConsumers []string
+	for _, consumer := range consumers {
+		score, err := p.consumerScore(queue, cgroup, consumer, false)
+		if err != nil {
+			return "", err
+		} else if score == 0 {
+			// The consumer expired since we scanned for it
+			continue
+		}
+		qqConsumers = append(qqConsumers, consumer)
+		qq = append(qq,
+			core.QueryAction{
+				QuerySelector: &core.QuerySelector{
+					Key: ewOwners.byArb,
+					QueryIDScoreSelect: &core.QueryIDScoreSelect{
+						ID:    id,
+						Equal: score,
+					},
+				},
+			},
+			core.QueryAction{CountInput: true},
+		)
+	}
+	if len(qq) == 0 {
+		return "", nil
+	}
+
+	qa := core.QueryActions{
+		KeyBase:      ewOwners.base,
+		QueryActions: qq,
+	}
+
+	res, err := p.c.Query(qa)
+	if err != nil {
+		return "", err
+	}
+	for i, count := range res.Counts {
+		if count > 0 {
+			return qqConsumers[i], nil
+		}
+	}
+	return "", nil
+}
+
+// returns the named consumer's score in the consumer group's owners set, or 0 if
+// it doesn't have one because it's never retrieved events or has expired. If
+// seen is set the consumer is marked as having been seen just now, and is given
+// a score if it doesn't have one
+func (p *Peel) consumerScore(queue, cgroup, consumer string, seen bool) (core.TS, error) {
+	keyScore, err := queueConsumerScore(queue, cgroup, consumer)
+	if err != nil {
+		return 0, err
+	}
+
+	now := core.NewTS(time.Now())
+	seenID := core.ID{T: now, Expire: core.NewTS(now.Time().Add(p.o.ConsumerExpire))}
+	qq := []core.QueryAction{{SingleGet: &keyScore}}
+	if seen {
+		keySeen, err := queueConsumerSeen(queue, cgroup, consumer)
+		if err != nil {
+			return 0, err
+		}
+		qq = []core.QueryAction{
+			{
+				QuerySelector: &core.QuerySelector{IDs: []core.ID{seenID}},
+			},
+			{
+				QuerySingleSet: &core.QuerySingleSet{Key: keySeen, ExpireAt: seenID.Expire},
+			},
+			{
+				SingleGet: &keyScore,
+			},
+			{
+				QuerySingleSet: &core.QuerySingleSet{Key: keyScore, ExpireAt: seenID.Expire},
+			},
+		}
+	}
+
+	qa := core.QueryActions{
+		KeyBase:      keyScore.Base,
+		QueryActions: qq,
+		Now:          now,
+	}
+	res, err := p.c.Query(qa)
+	if err != nil {
+		return 0, err
+	} else if len(res.IDs) > 0 {
+		return res.IDs[0].T, nil
+	} else if !seen {
+		return 0, nil
+	}
+
+	// The consumer is new, so it's given the T of a new ID as its score,
+	// unless it's been given one in the meantime. The ID itself never expires,
+	// only the key holding it does.
+	e, err := p.c.NewEvent(now, consumerScoreExpire, "")
+	if err != nil {
+		return 0, err
+	}
+	qa.QueryActions = []core.QueryAction{
+		{
+			SingleGet: &keyScore,
+		},
+		{
+			QueryConditional: core.QueryConditional{IfNoInput: true},
+			QuerySelector:    &core.QuerySelector{IDs: []core.ID{e.ID}},
+		},
+		{
+			QuerySingleSet: &core.QuerySingleSet{Key: keyScore, ExpireAt: seenID.Expire},
+		},
+	}
+	if res, err = p.c.Query(qa); err != nil {
+		return 0, err
+	} else if len(res.IDs) == 0 {
+		return 0, errors.New("consumer score not set")
+	}
+	return res.IDs[0].T, nil
+}
+
+// QNackCommand describes the parameters which can be passed into the QNack
+// command
+type QNackCommand struct {
+	Queue         string  // Required
+	ConsumerGroup string  // Required
+	EventID       core.ID // Required
+
+	// Optional. The name of the consumer giving up the event, see the Consumer
+	// field on QAckCommand
+	Consumer string
+
+	// If set the event is put back even if it's held by a consumer other than
+	// Consumer
+	Force bool
+}
+
+// QNack indicates that an event could not be processed successfully, and should
+// be made available to the consumer group to be retrieved again immediately,
+// rather than waiting for its ack deadline to pass. Only applicable for Events
+// which were gotten through a QGet with an AckDeadline. Returns true if the
+// Event was successfully put back. false will be returned if the deadline was
+// already missed, or the event was already acknowledged.
+//
+// If the Event has already been retrieved MaxDeliveries times it is moved to
+// the consumer group's dead set instead, and true is still returned.
+//
+// Like with QAck, if the event is held by a consumer other than Consumer then
+// a NotOwnerError is returned, unless Force is set.
+func (p *Peel) QNack(c QNackCommand) (bool, error) {
+	now := core.NewTS(time.Now())
+
+	ewDeliv, ewDead, err := queueCGroupRetryKeys(c.Queue, c.ConsumerGroup)
+	if err != nil {
+		return false, err
+	}
+
+	keyNotify, err := queueNotify(c.Queue)
+	if err != nil {
+		return false, err
+	}
+
+	var qqOwner []core.QueryAction
+	if !c.Force {
+		if qqOwner, err = p.ownerFilter(c.Queue, c.ConsumerGroup, c.Consumer); err != nil {
+			return false, err
+		}
+	}
+
+	var qq, qqSel, qqRetry []core.QueryAction
+	for _, priority := range p.priorities() {
+		ewInProg, ewRedo, _, err := queueCGroupKeys(c.Queue, c.ConsumerGroup, priority)
+		if err != nil {
+			return false, err
+		}
+
+		qq = append(qq, ewInProg.removeExpired(now)...)
+		sel := ewInProg.selectID(c.EventID, now)
+		qqRetry = append(qqRetry, p.retry(append([]core.QueryAction{sel}, qqOwner...), ewInProg, ewRedo, ewDeliv, ewDead)...)
+		sel.Union = len(qqSel) > 0
+		qqSel = append(qqSel, sel)
+	}
+
+	// When checking the owner the first count tells whether the event was in
+	// progress at all
+	if !c.Force {
+		qq = append(qq, qqSel...)
+		qq = append(qq, core.QueryAction{CountInput: true})
+	}
+	qq = append(qq, qqRetry...)
+
+	qa := core.QueryActions{
+		KeyBase:      ewDeliv.base,
+		QueryActions: qq,
+		Now:          now,
+	}
+
+	res, err := p.c.Query(qa)
+	if err != nil {
+		return false, err
+	}
+
+	counts := res.Counts
+	if !c.Force {
+		counts = counts[1:]
+	}
+	var moved uint64
+	for _, count := range counts {
+		moved += count
+	}
+	if moved == 0 && !c.Force && res.Counts[0] > 0 {
+		return false, p.notOwnerErr(c.Queue, c.ConsumerGroup, c.EventID)
+	} else if moved == 0 {
+		return false, nil
+	}
+
+	// Wake up any consumers blocking on the queue, so one of them can pick the
+	// event back up
+	p.c.KeyNotify(keyNotify)
+	return true, nil
+}
+
+// QExtendCommand describes the parameters which can be passed into the QExtend
+// command
+type QExtendCommand struct {
+	Queue         string    // Required
+	ConsumerGroup string    // Required
+	EventID       core.ID   // Required
+	AckDeadline   time.Time // Required
+
+	// Optional. The name of the consumer extending the event's deadline, see
+	// the Consumer field on QAckCommand
+	Consumer string
+
+	// If set the deadline is changed even if the event is held by a consumer
+	// other than Consumer
+	Force bool
+}
+
+// QExtend changes the ack deadline of an event which is currently in progress
+// to be AckDeadline, giving the consumer more (or less) time to QAck it. Only
+// applicable for Events which were gotten through a QGet with an AckDeadline.
+// Returns true if the deadline was changed. false will be returned if the
+// original deadline was already missed, or the event was already acknowledged.
+//
+// Like with QAck, if the event is held by a consumer other than Consumer then
+// a NotOwnerError is returned, unless Force is set.
+func (p *Peel) QExtend(c QExtendCommand) (bool, error) {
+	now := core.NewTS(time.Now())
+
+	var qqOwner []core.QueryAction
+	if !c.Force {
+		var err error
+		if qqOwner, err = p.ownerFilter(c.Queue, c.ConsumerGroup, c.Consumer); err != nil {
+			return false, err
+		}
+	}
+
+	var base string
+	var qq, qqSel, qqExtend []core.QueryAction
+	for _, priority := range p.priorities() {
+		ewInProg, err := queueInProgress(c.Queue, c.ConsumerGroup, priority)
+		if err != nil {
+			return false, err
+		}
+		base = ewInProg.base
+
+		qq = append(qq, ewInProg.removeExpired(now)...)
+		sel := ewInProg.selectID(c.EventID, now)
+		qqExtend = append(qqExtend, sel)
+		qqExtend = append(qqExtend, qqOwner...)
+		qqExtend = append(qqExtend, ewInProg.addFromInput(core.NewTS(c.AckDeadline))...)
+		qqExtend = append(qqExtend, core.QueryAction{CountInput: true})
+		sel.Union = len(qqSel) > 0
+		qqSel = append(qqSel, sel)
+	}
+
+	// When checking the owner the first count tells whether the event was in
+	// progress at all
+	if !c.Force {
+		qq = append(qq, qqSel...)
+		qq = append(qq, core.QueryAction{CountInput: true})
+	}
+	qq = append(qq, qqExtend...)
+
+	qa := core.QueryActions{
+		KeyBase:      base,
+		QueryActions: qq,
+		Now:          now,
+	}
+
+	res, err := p.c.Query(qa)
+	if err != nil {
+		return false, err
+	}
+
+	counts := res.Counts
+	if !c.Force {
+		counts = counts[1:]
+	}
+	var extended uint64
+	for _, count := range counts {
+		extended += count
+	}
+	if extended == 0 && !c.Force && res.Counts[0] > 0 {
+		return false, p.notOwnerErr(c.Queue, c.ConsumerGroup, c.EventID)
+	}
+	return extended > 0, nil
+}
+
+// QSeekCommand describes the parameters which can be passed into the QSeek
+// command. At most one of EventID, Time and Latest should be set. If none of
+// them are then the consumer group is moved to the oldest event in the queue.
+type QSeekCommand struct {
+	Queue         string // Required
+	ConsumerGroup string // Required
+
+	// The consumer group will next retrieve the event with this ID, and then
+	// continue on with the events after it
+	EventID core.ID
+
+	// The consumer group will next retrieve the first event added at or after
+	// this time
+	Time time.Time
+
+	// The consumer group will only retrieve events added after this call
+	Latest bool
+
+	// If set, all events the consumer group is waiting to redo are discarded
+	ClearRedo bool
+}
+
+// QSeek moves the consumer group's position in the queue, changing which events
+// it will retrieve next. This can be used to replay events which have already
+// been retrieved, or to skip over events which haven't. Events which are
+// currently in progress are not affected.
+func (p *Peel) QSeek(c QSeekCommand) error {
+	now := core.NewTS(time.Now())
 
-	// First clean expired events from everything
+	var target core.TS
+	if c.EventID != (core.ID{}) {
+		target = c.EventID.T
+	} else if !c.Time.IsZero() {
+		target = core.NewTS(c.Time)
+	}
+
+	var base string
 	var qq []core.QueryAction
-	qq = append(qq, ewInProg.removeExpired(now)...)
-	qq = append(qq, ewRedo.removeExpired(now)...)
+	for _, priority := range p.priorities() {
+		ewAvail, err := queueAvailable(c.Queue, priority)
+		if err != nil {
+			return err
+		}
+
+		_, ewRedo, keyPtr, err := queueCGroupKeys(c.Queue, c.ConsumerGroup, priority)
+		if err != nil {
+			return err
+		}
+		base = ewAvail.base
+
+		if c.ClearRedo {
+			qq = append(qq, ewRedo.del()...)
+		}
+
+		// The pointer is set to the newest event before the one we want to
+		// retrieve next. If there isn't one then it's deleted, so that the
+		// consumer group starts from the oldest event.
+		var sel core.QueryAction
+		if c.Latest {
+			sel = core.QueryAction{
+				QuerySelector: &core.QuerySelector{
+					Key:            ewAvail.byArb,
+					PosRangeSelect: []int64{-1, -1},
+				},
+			}
+		} else if target > 0 {
+			sel = ewAvail.before(target, 1)
+		} else {
+			qq = append(qq, core.QueryAction{Delete: &keyPtr})
+			continue
+		}
+
+		qq = append(qq, sel, core.QueryAction{
+			Delete: &keyPtr,
+			QueryConditional: core.QueryConditional{
+				IfNoInput: true,
+			},
+		}, core.QueryAction{
+			QuerySingleSet: &core.QuerySingleSet{
+				Key: keyPtr,
+			},
+		})
+	}
+
+	qa := core.QueryActions{
+		KeyBase:      base,
+		QueryActions: qq,
+		Now:          now,
+	}
+
+	_, err := p.c.Query(qa)
+	return err
+}
+
+// QRemCommand describes the parameters which can be passed into the QRem
+// command
+type QRemCommand struct {
+	Queue   string  // Required
+	EventID core.ID // Required
+}
+
+// QRem removes an event from the queue entirely, so that no consumer group will
+// retrieve it, and deletes the event itself. The event is removed from the
+// queue's available and scheduled sets at every priority level, and from every
+// consumer group's in progress, redo and dead sets. Returns true if the event
+// was found anywhere in the queue. If it wasn't the event is left alone, since
+// it may belong to some other queue.
+func (p *Peel) QRem(c QRemCommand) (bool, error) {
+	found, err := p.remEvents(c.Queue, []core.ID{c.EventID})
+	if err != nil || len(found) == 0 {
+		return false, err
+	}
+
+	// Only delete the event if it was found, since it may belong to some
+	// other queue
+	if err := p.c.DelEvents(found); err != nil {
+		return false, err
+	}
+
+	// Wake up any producers waiting for room in the queue, see queueSpace
+	keySpace, err := queueSpace(c.Queue)
+	if err != nil {
+		return false, err
+	}
+	p.c.KeyNotify(keySpace)
+	return true, nil
+}
+
+// removes the given events from the queue, as described by QRem. Returns those
+// of the events which were found anywhere in the queue. The events themselves
+// are not deleted
+func (p *Peel) remEvents(queue string, ii []core.ID) ([]core.ID, error) {
+	if len(ii) == 0 {
+		return []core.ID{}, nil
+	}
+
+	cgs, err := p.queueConsumerGroups(queue)
+	if err != nil {
+		return nil, err
+	}
+
+	ewSizes, err := queueSizes(queue)
+	if err != nil {
+		return nil, err
+	}
 
-	// find all events who missed their ack deadline, remove them from inProg
-	// and add them to redo
-	qq = append(qq, ewInProg.before(now, 0))
+	var ewUnchecked, ewIDs []exWrap
+	for _, cg := range cgs {
+		ewDeliv, ewDead, err := queueCGroupRetryKeys(queue, cg)
+		if err != nil {
+			return nil, err
+		}
+		ewUnchecked = append(ewUnchecked, ewDeliv)
+		ewIDs = append(ewIDs, ewDead)
+	}
+	for _, priority := range p.priorities() {
+		ewAvail, err := queueAvailable(queue, priority)
+		if err != nil {
+			return nil, err
+		}
+		ewSched, err := queueScheduled(queue, priority)
+		if err != nil {
+			return nil, err
+		}
+		ewIDs = append(ewIDs, ewAvail, ewSched)
+
+		for _, cg := range cgs {
+			ewInProg, ewRedo, _, err := queueCGroupKeys(queue, cg, priority)
+			if err != nil {
+				return nil, err
+			}
+			ewIDs = append(ewIDs, ewInProg, ewRedo)
+		}
+	}
+
+	// Check every set for the events, then remove them from all of them. The
+	// deliveries and sizes sets aren't checked since an event is only ever in
+	// one of those if it's in some other set as well.
+	var qq []core.QueryAction
+	remove := core.QueryAction{}
+	for _, ew := range ewIDs {
+		for _, id := range ii {
+			sel := ew.selectID(id, 0)
+			sel.Union = len(qq) > 0
+			qq = append(qq, sel)
+		}
+		remove.RemoveFrom = append(remove.RemoveFrom, ew.byArb, ew.byExp)
+	}
+	for _, ew := range ewUnchecked {
+		remove.RemoveFrom = append(remove.RemoveFrom, ew.byArb, ew.byExp)
+	}
+	qq = append(qq, ewSizes.removeFromInput()...)
+	qq = append(qq, remove)
+
+	qa := core.QueryActions{
+		KeyBase:      ewIDs[0].base,
+		QueryActions: qq,
+	}
+
+	res, err := p.c.Query(qa)
+	if err != nil {
+		return nil, err
+	}
+	return res.IDs, nil
+}
+
+// returns actions which will take the IDs output by the sel actions, remove
+// them from inProg, and add them to either redo or, if they've been retrieved
+// MaxDeliveries times already, dead. sel is performed once for each of those
+// two cases, so it must only output IDs which are still in inProg. The number
+// of IDs moved in each case is appended to the result's Counts
+func (p *Peel) retry(sel []core.QueryAction, ewInProg, ewRedo, ewDeliv, ewDead exWrap) []core.QueryAction {
+	var qq []core.QueryAction
+
+	if p.o.MaxDeliveries > 0 {
+		qq = append(qq, sel...)
+		qq = append(qq, core.QueryAction{
+			QueryFilter: &core.QueryFilter{
+				InKey: &ewDeliv.byArb,
+				ScoreRange: core.QueryScoreRange{
+					Min: core.TS(p.o.MaxDeliveries),
+				},
+				Invert: true,
+			},
+		})
+		qq = append(qq, ewInProg.removeFromInput(), ewDeliv.removeFromInput())
+		qq = append(qq, ewDead.addFromInput(0)...)
+		qq = append(qq, core.QueryAction{CountInput: true})
+	}
+
+	qq = append(qq, sel...)
 	qq = append(qq, ewInProg.removeFromInput())
 	qq = append(qq, ewRedo.addFromInput(0)...)
+	qq = append(qq, core.QueryAction{CountInput: true})
+	return qq
+}
 
-	// get the pointer, if there's no events equal to or older than it in the
-	// queue, delete it
-	qq = append(qq, core.QueryAction{SingleGet: &keyPtr})
-	qq = append(qq, beforeAvail)
-	qq = append(qq, core.QueryAction{
-		Delete: &keyPtr,
-		QueryConditional: core.QueryConditional{
-			IfNoInput: true,
+// returns actions which will remove all events from the owners set which are
+// no longer in progress for the consumer group at any priority level
+func (p *Peel) pruneOwners(queue, cgroup string, ewOwners exWrap) ([]core.QueryAction, error) {
+	qq := []core.QueryAction{{
+		QuerySelector: &core.QuerySelector{
+			Key:              ewOwners.byArb,
+			QueryRangeSelect: &core.QueryRangeSelect{},
 		},
-	})
+	}}
+	for _, priority := range p.priorities() {
+		ewInProg, err := queueInProgress(queue, cgroup, priority)
+		if err != nil {
+			return nil, err
+		}
+		qq = append(qq, core.QueryAction{
+			QueryFilter: &core.QueryFilter{InKey: &ewInProg.byArb},
+		})
+	}
+	return append(qq, ewOwners.removeFromInput()), nil
+}
+
+// Clean finds all the events which were retrieved for the given
+// queue/consumerGroup which weren't ack'd by the deadline, and makes them
+// available to be retrieved again. Events which have already been retrieved
+// MaxDeliveries times are moved to the consumer group's dead set instead.
+func (p *Peel) Clean(queue, consumerGroup string) error {
+	now := core.NewTS(time.Now())
+
+	ewDeliv, ewDead, err := queueCGroupRetryKeys(queue, consumerGroup)
+	if err != nil {
+		return err
+	}
+
+	// First clean expired events from everything not specific to a priority
+	// level
+	var qq []core.QueryAction
+	qq = append(qq, ewDeliv.removeExpired(now)...)
+	qq = append(qq, ewDead.removeExpired(now)...)
+
+	for _, priority := range p.priorities() {
+		ewAvail, err := queueAvailable(queue, priority)
+		if err != nil {
+			return err
+		}
+
+		// This is a giant hack. But this is literally the only case where we
+		// don't want to exclude the right side afaik, and we *have* to include
+		// it no matter what, so it seemed weird to add a new method or a
+		// parameter to an existing method. Don't do this again.
+		beforeAvail := ewAvail.beforeInput(1)
+		beforeAvail.QuerySelector.QueryRangeSelect.QueryScoreRange.MaxExcl = false
+
+		ewInProg, ewRedo, keyPtr, err := queueCGroupKeys(queue, consumerGroup, priority)
+		if err != nil {
+			return err
+		}
+
+		// Clean expired events from everything at this priority level
+		qq = append(qq, ewInProg.removeExpired(now)...)
+		qq = append(qq, ewRedo.removeExpired(now)...)
+
+		// find all events who missed their ack deadline, remove them from
+		// inProg and add them to redo (or dead, if they've been tried too many
+		// times)
+		sel := []core.QueryAction{ewInProg.before(now, 0)}
+		qq = append(qq, p.retry(sel, ewInProg, ewRedo, ewDeliv, ewDead)...)
+
+		// get the pointer, if there's no events equal to or older than it in
+		// the queue, delete it
+		qq = append(qq, core.QueryAction{SingleGet: &keyPtr})
+		qq = append(qq, beforeAvail)
+		qq = append(qq, core.QueryAction{
+			Delete: &keyPtr,
+			QueryConditional: core.QueryConditional{
+				IfNoInput: true,
+			},
+		})
+	}
+
+	// Now that events which missed their deadline are out of inProg, they can
+	// be cleared out of owners
+	ewOwners, err := queueOwners(queue, consumerGroup)
+	if err != nil {
+		return err
+	}
+	qqPrune, err := p.pruneOwners(queue, consumerGroup, ewOwners)
+	if err != nil {
+		return err
+	}
+	qq = append(qq, qqPrune...)
 
 	qa := core.QueryActions{
-		KeyBase:      keyPtr.Base,
+		KeyBase:      ewDeliv.base,
 		QueryActions: qq,
 		Now:          now,
 	}
@@ -402,18 +1648,35 @@ func (p *Peel) Clean(queue, consumerGroup string) error {
 }
 
 // CleanAvailable cleans up expired events out of the given queue's set of
-// events which are available for consumer groups to retrieve
+// events which are available for consumer groups to retrieve, and makes
+// available any scheduled events which are due
 func (p *Peel) CleanAvailable(queue string) error {
 	now := core.NewTS(time.Now())
 
-	ewAvail, err := queueAvailable(queue)
+	ewSizes, err := queueSizes(queue)
 	if err != nil {
 		return err
 	}
 
+	qq := ewSizes.removeExpired(now)
+	for _, priority := range p.priorities() {
+		ewAvail, err := queueAvailable(queue, priority)
+		if err != nil {
+			return err
+		}
+
+		ewSched, err := queueScheduled(queue, priority)
+		if err != nil {
+			return err
+		}
+
+		qq = append(qq, ewAvail.removeExpired(now)...)
+		qq = append(qq, promoteScheduled(now, ewSched, ewAvail)...)
+	}
+
 	qa := core.QueryActions{
-		KeyBase:      ewAvail.base,
-		QueryActions: ewAvail.removeExpired(now),
+		KeyBase:      ewSizes.base,
+		QueryActions: qq,
 		Now:          now,
 	}
 
@@ -442,7 +1705,201 @@ func (p *Peel) CleanAll() error {
 	return err
 }
 
-// ConsumerGroupStats are available statistics about a queue/consumer group.
+// DeleteConsumerGroup removes all data related to the given consumer group on
+// the given queue, including its position in the queue and any events it has
+// in progress or waiting to be redone. The events themselves are not affected.
+// Once deleted the consumer group will no longer be returned from
+// AllQueuesConsumerGroups. If a consumer in the group calls QGet again the
+// group will be recreated, starting from the oldest event in the queue.
+func (p *Peel) DeleteConsumerGroup(queue, consumerGroup string) error {
+	ewDeliv, ewDead, err := queueCGroupRetryKeys(queue, consumerGroup)
+	if err != nil {
+		return err
+	}
+
+	ewOwners, err := queueOwners(queue, consumerGroup)
+	if err != nil {
+		return err
+	}
+
+	consumers, err := p.queueConsumers(queue, consumerGroup)
+	if err != nil {
+		return err
+	}
+
+	var qq []core.QueryAction
+	qq = append(qq, ewDeliv.del()...)
+	qq = append(qq, ewDead.del()...)
+	qq = append(qq, ewOwners.del()...)
+	for _, consumer := range consumers {
+		keySeen, err := queueConsumerSeen(queue, consumerGroup, consumer)
+		if err != nil {
+			return err
+		}
+		keyScore, err := queueConsumerScore(queue, consumerGroup, consumer)
+		if err != nil {
+			return err
+		}
+		qq = append(qq, core.QueryAction{Delete: &keySeen}, core.QueryAction{Delete: &keyScore})
+	}
+	for _, priority := range p.priorities() {
+		ewInProg, ewRedo, keyPtr, err := queueCGroupKeys(queue, consumerGroup, priority)
+		if err != nil {
+			return err
+		}
+		qq = append(qq, ewInProg.del()...)
+		qq = append(qq, ewRedo.del()...)
+		qq = append(qq, core.QueryAction{Delete: &keyPtr})
+	}
+
+	qa := core.QueryActions{
+		KeyBase:      ewDeliv.base,
+		QueryActions: qq,
+	}
+
+	_, err = p.c.Query(qa)
+	return err
+}
+
+// PurgeQueue removes all events which are currently available in the given
+// queue, at all priority levels. Consumer groups are kept, along with any
+// events they have in progress or waiting to be redone. Scheduled events are
+// not removed, and will still become available once they are due.
+func (p *Peel) PurgeQueue(queue string) error {
+	ewSizes, err := queueSizes(queue)
+	if err != nil {
+		return err
+	}
+
+	// The purged events no longer count against the queue's limits, so they're
+	// selected and removed from the sizes set before being deleted
+	var qq, qqDel []core.QueryAction
+	for _, priority := range p.priorities() {
+		ewAvail, err := queueAvailable(queue, priority)
+		if err != nil {
+			return err
+		}
+		qq = append(qq, core.QueryAction{
+			QuerySelector: &core.QuerySelector{
+				Key:              ewAvail.byArb,
+				QueryRangeSelect: &core.QueryRangeSelect{},
+			},
+			Union: true,
+		})
+		qqDel = append(qqDel, ewAvail.del()...)
+	}
+	qq = append(qq, ewSizes.removeFromInput()...)
+	qq = append(qq, qqDel...)
+
+	qa := core.QueryActions{
+		KeyBase:      ewSizes.base,
+		QueryActions: qq,
+	}
+
+	if _, err := p.c.Query(qa); err != nil {
+		return err
+	}
+
+	// Wake up any producers waiting for room in the queue, see queueSpace
+	p.c.KeyNotify(ewSizes.byArb)
+	return nil
+}
+
+// DeleteQueue removes the given queue entirely. All of its events, scheduled
+// events and consumer groups are removed, and the events which were referenced
+// by the queue are deleted as well.
+func (p *Peel) DeleteQueue(queue string) error {
+	// Make sure the queue name is valid before scanning for keys with it
+	if _, err := queueKeyMarshal(core.Key{Base: queue}); err != nil {
+		return err
+	}
+
+	kk, err := p.c.KeyScan(core.Key{Base: queue, Subs: []string{"*"}})
+	if err != nil {
+		return err
+	} else if len(kk) == 0 {
+		return nil
+	}
+
+	var ewIDs []exWrap
+	cgs := map[string]struct{}{}
+	for _, k := range kk {
+		if k, err = queueKeyUnmarshal(k); err != nil {
+			return err
+		}
+		if cg, ok := keyConsumerGroup(k); ok {
+			cgs[cg] = struct{}{}
+		}
+	}
+
+	for _, priority := range p.priorities() {
+		ewAvail, err := queueAvailable(queue, priority)
+		if err != nil {
+			return err
+		}
+		ewSched, err := queueScheduled(queue, priority)
+		if err != nil {
+			return err
+		}
+		ewIDs = append(ewIDs, ewAvail, ewSched)
+
+		for cg := range cgs {
+			ewInProg, ewRedo, _, err := queueCGroupKeys(queue, cg, priority)
+			if err != nil {
+				return err
+			}
+			ewIDs = append(ewIDs, ewInProg, ewRedo)
+		}
+	}
+	for cg := range cgs {
+		_, ewDead, err := queueCGroupRetryKeys(queue, cg)
+		if err != nil {
+			return err
+		}
+		ewIDs = append(ewIDs, ewDead)
+	}
+
+	// Select every ID referenced by the queue, then delete every key the queue
+	// has. Deleting passes its input through, so the output is the selected IDs
+	var qq []core.QueryAction
+	for _, ew := range ewIDs {
+		qq = append(qq, core.QueryAction{
+			QuerySelector: &core.QuerySelector{
+				Key:              ew.byArb,
+				QueryRangeSelect: &core.QueryRangeSelect{},
+			},
+			Union: true,
+		})
+	}
+	for i := range kk {
+		qq = append(qq, core.QueryAction{Delete: &kk[i]})
+	}
+
+	qa := core.QueryActions{
+		KeyBase:      queue,
+		QueryActions: qq,
+	}
+
+	res, err := p.c.Query(qa)
+	if err != nil {
+		return err
+	}
+
+	if err := p.c.DelEvents(res.IDs); err != nil {
+		return err
+	}
+
+	// Wake up any producers waiting for room in the queue, see queueSpace
+	keySpace, err := queueSpace(queue)
+	if err != nil {
+		return err
+	}
+	p.c.KeyNotify(keySpace)
+	return nil
+}
+
+// ConsumerGroupStats are available statistics about a queue/consumer group. All
+// counts are summed across all priority levels.
 type ConsumerGroupStats struct {
 	// Number of events the consumer group has yet to process for the queue
 	Available uint64
@@ -452,14 +1909,24 @@ type ConsumerGroupStats struct {
 
 	// Number of events awaiting being re-attempted by the consumer group
 	Redo uint64
+
+	// Number of events which weren't acknowledged after being retrieved
+	// MaxDeliveries times, and so won't be re-attempted by the consumer group
+	Dead uint64
 }
 
-// QueueStats are available statistics about a queue across all consumer groups
+// QueueStats are available statistics about a queue across all consumer
+// groups. All counts are summed across all priority levels.
 type QueueStats struct {
 	// Number of events for the queue in the system. Will be the same regardless
 	// of consumer group. Does NOT include expired events.
 	Total uint64
 
+	// Number of events for the queue which have been added but won't be
+	// available to any consumer group until some point in the future. These are
+	// not included in Total.
+	Scheduled uint64
+
 	// Statistics for each consumer group known for the queue. The key will be
 	// the consumer group's name
 	ConsumerGroupStats map[string]ConsumerGroupStats
@@ -467,33 +1934,53 @@ type QueueStats struct {
 
 func (p *Peel) qstatus(queue string, cgroups []string) (QueueStats, error) {
 	now := core.NewTS(time.Now())
-	ewAvail, err := queueAvailable(queue)
-	if err != nil {
-		return QueueStats{}, err
-	}
+	priorities := p.priorities()
 
 	var qq []core.QueryAction
-	qq = append(qq, ewAvail.removeExpired(now)...)
-	qq = append(qq, ewAvail.countNotExpired(now))
+	ewAvails := make([]exWrap, len(priorities))
+	for i, priority := range priorities {
+		ewAvail, err := queueAvailable(queue, priority)
+		if err != nil {
+			return QueueStats{}, err
+		}
+
+		ewSched, err := queueScheduled(queue, priority)
+		if err != nil {
+			return QueueStats{}, err
+		}
+		ewAvails[i] = ewAvail
+
+		qq = append(qq, ewAvail.removeExpired(now)...)
+		qq = append(qq, promoteScheduled(now, ewSched, ewAvail)...)
+		qq = append(qq, ewAvail.countNotExpired(now))
+		qq = append(qq, ewSched.countNotExpired(now))
+	}
 
 	for _, cg := range cgroups {
-		var ewInProg, ewRedo exWrap
-		var keyPtr core.Key
-		if ewInProg, ewRedo, keyPtr, err = queueCGroupKeys(queue, cg); err != nil {
+		ewDead, err := queueDead(queue, cg)
+		if err != nil {
 			return QueueStats{}, err
 		}
-		qq = append(qq,
-			core.QueryAction{
-				SingleGet: &keyPtr,
-			},
-			ewAvail.countAfterInput(),
-			ewInProg.countNotExpired(now),
-			ewRedo.countNotExpired(now),
-		)
+		qq = append(qq, ewDead.countNotExpired(now))
+
+		for i, priority := range priorities {
+			ewInProg, ewRedo, keyPtr, err := queueCGroupKeys(queue, cg, priority)
+			if err != nil {
+				return QueueStats{}, err
+			}
+			qq = append(qq,
+				core.QueryAction{
+					SingleGet: &keyPtr,
+				},
+				ewAvails[i].countAfterInput(),
+				ewInProg.countNotExpired(now),
+				ewRedo.countNotExpired(now),
+			)
+		}
 	}
 
 	qa := core.QueryActions{
-		KeyBase:      ewAvail.base,
+		KeyBase:      ewAvails[0].base,
 		QueryActions: qq,
 		Now:          now,
 	}
@@ -504,18 +1991,26 @@ func (p *Peel) qstatus(queue string, cgroups []string) (QueueStats, error) {
 	}
 
 	qs := QueueStats{
-		Total:              res.Counts[0],
 		ConsumerGroupStats: map[string]ConsumerGroupStats{},
 	}
-	res.Counts = res.Counts[1:]
+	for range priorities {
+		qs.Total += res.Counts[0]
+		qs.Scheduled += res.Counts[1]
+		res.Counts = res.Counts[2:]
+	}
 
 	for _, cg := range cgroups {
-		qs.ConsumerGroupStats[cg] = ConsumerGroupStats{
-			Available:  res.Counts[0],
-			InProgress: res.Counts[1],
-			Redo:       res.Counts[2],
+		cgs := ConsumerGroupStats{
+			Dead: res.Counts[0],
+		}
+		res.Counts = res.Counts[1:]
+		for range priorities {
+			cgs.Available += res.Counts[0]
+			cgs.InProgress += res.Counts[1]
+			cgs.Redo += res.Counts[2]
+			res.Counts = res.Counts[3:]
 		}
-		res.Counts = res.Counts[3:]
+		qs.ConsumerGroupStats[cg] = cgs
 	}
 	return qs, nil
 }
@@ -552,6 +2047,109 @@ func (p *Peel) QStatus(c QStatusCommand) (map[string]QueueStats, error) {
 	return ret, nil
 }
 
+// ConsumerStats are available statistics about a single named consumer within a
+// consumer group
+type ConsumerStats struct {
+	Name string
+
+	// The last time the consumer retrieved events, or tried to
+	LastSeen time.Time
+
+	// Number of events retrieved by the consumer which are still in progress,
+	// summed across all priority levels
+	InProgress uint64
+}
+
+// QConsumers returns statistics about all consumers in the given consumer
+// group, sorted by name. Only consumers which have retrieved events with
+// Consumer set in the last ConsumerExpire are returned.
+func (p *Peel) QConsumers(queue, consumerGroup string) ([]ConsumerStats, error) {
+	consumers, err := p.queueConsumers(queue, consumerGroup)
+	if err != nil {
+		return nil, err
+	}
+
+	ewOwners, err := queueOwners(queue, consumerGroup)
+	if err != nil {
+		return nil, err
+	}
+
+	now := core.NewTS(time.Now())
+	ret := make([]ConsumerStats, 0, len(consumers))
+	for _, consumer := range consumers {
+		keySeen, err := queueConsumerSeen(queue, consumerGroup, consumer)
+		if err != nil {
+			return nil, err
+		}
+
+		score, err := p.consumerScore(queue, consumerGroup, consumer, false)
+		if err != nil {
+			return nil, err
+		} else if score == 0 {
+			// The consumer expired since we scanned for it
+			continue
+		}
+
+		// Count the consumer's events which are in progress at each priority
+		// level, then output its seen ID
+		var qq []core.QueryAction
+		for _, priority := range p.priorities() {
+			ewInProg, err := queueInProgress(queue, consumerGroup, priority)
+			if err != nil {
+				return nil, err
+			}
+			qq = append(qq,
+				core.QueryAction{
+					QuerySelector: &core.QuerySelector{
+						Key: ewOwners.byArb,
+						QueryRangeSelect: &core.QueryRangeSelect{
+							QueryScoreRange: core.QueryScoreRange{
+								Min: score,
+								Max: score,
+							},
+						},
+					},
+				},
+				core.QueryAction{
+					QueryFilter: &core.QueryFilter{
+						InKey: &ewInProg.byArb,
+						ScoreRange: core.QueryScoreRange{
+							Min:     now,
+							MinExcl: true,
+						},
+						Invert: true,
+					},
+				},
+				core.QueryAction{CountInput: true},
+			)
+		}
+		qq = append(qq, core.QueryAction{SingleGet: &keySeen})
+
+		qa := core.QueryActions{
+			KeyBase:      ewOwners.base,
+			QueryActions: qq,
+			Now:          now,
+		}
+
+		res, err := p.c.Query(qa)
+		if err != nil {
+			return nil, err
+		} else if len(res.IDs) == 0 {
+			// The consumer expired since we scanned for it
+			continue
+		}
+
+		cs := ConsumerStats{Name: consumer, LastSeen: res.IDs[0].T.Time()}
+		for _, count := range res.Counts {
+			cs.InProgress += count
+		}
+		ret = append(ret, cs)
+	}
+
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret, nil
+}
+
 // Helper method for QInfo. Given an integer and a string or another integer,
 // returns the max of the given int and the length of the given string or the
 // string form of the given integer
@@ -571,26 +2169,28 @@ func maxLength(oldMax int, elStr string, elInt uint64) int {
 }
 
 func cgStatsInfos(cgsm map[string]ConsumerGroupStats) []string {
-	var cgL, availL, inProgL, redoL int
+	var cgL, availL, inProgL, redoL, deadL int
 
 	for cg, cgs := range cgsm {
 		cgL = maxLength(cgL, cg, 0)
 		availL = maxLength(availL, "", cgs.Available)
 		inProgL = maxLength(inProgL, "", cgs.InProgress)
 		redoL = maxLength(redoL, "", cgs.Redo)
+		deadL = maxLength(deadL, "", cgs.Dead)
 	}
 
 	fmtStr := fmt.Sprintf(
-		"consumerGroup:%%-%dq avail:%%-%dd inProg:%%-%dd redo:%%-%dd",
+		"consumerGroup:%%-%dq avail:%%-%dd inProg:%%-%dd redo:%%-%dd dead:%%-%dd",
 		cgL,
 		availL,
 		inProgL,
 		redoL,
+		deadL,
 	)
 
 	var r []string
 	for cg, cgs := range cgsm {
-		r = append(r, fmt.Sprintf(fmtStr, cg, cgs.Available, cgs.InProgress, cgs.Redo))
+		r = append(r, fmt.Sprintf(fmtStr, cg, cgs.Available, cgs.InProgress, cgs.Redo, cgs.Dead))
 	}
 	return r
 }
@@ -605,7 +2205,7 @@ func (p *Peel) QInfo(c QStatusCommand) ([]string, error) {
 
 	var r []string
 	for q, qs := range m {
-		r = append(r, fmt.Sprintf("queue:%q total:%d", q, qs.Total))
+		r = append(r, fmt.Sprintf("queue:%q total:%d scheduled:%d", q, qs.Total, qs.Scheduled))
 		r = append(r, cgStatsInfos(qs.ConsumerGroupStats)...)
 	}
 	return r, nil
@@ -1,6 +1,7 @@
 package peel
 
 import (
+	"os"
 	. "testing"
 	"time"
 
@@ -11,18 +12,22 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
+// newTestPeel returns a Peel backed by a core.Mem, unless BANANAQ_TEST_REDIS is
+// set to the address of a redis instance, in which case a core.Core using it is
+// used instead
 func newTestPeel() *Peel {
-	p, err := pool.New("tcp", "127.0.0.1:6379", 10)
-	if err != nil {
-		panic(err)
-	}
-
-	o := Opts{
-		Opts: core.Opts{
+	var c Backend = core.NewMem()
+	if addr := os.Getenv("BANANAQ_TEST_REDIS"); addr != "" {
+		p, err := pool.New("tcp", addr, 10)
+		if err != nil {
+			panic(err)
+		}
+		c = core.New(p, &core.Opts{
 			RedisPrefix: testutil.RandStr(),
-		},
+		})
 	}
-	peel := New(p, &o)
+
+	peel := New(c, nil)
 	errCh := peel.Run(nil)
 	go func() { panic(<-errCh) }()
 	return peel
@@ -75,15 +80,17 @@ func assertSingleKey(t *T, k core.Key, id ...core.ID) {
 func TestQAdd(t *T) {
 	queue := testutil.RandStr()
 	contents := testutil.RandStr()
+	headers := map[string]string{"content-type": "text/plain"}
 	id, err := testPeel.QAdd(QAddCommand{
 		Queue:    queue,
 		Expire:   time.Now().Add(10 * time.Second),
 		Contents: contents,
+		Headers:  headers,
 	})
 	require.Nil(t, err)
 	assert.NotZero(t, id)
 
-	ewAvail, err := queueAvailable(queue)
+	ewAvail, err := queueAvailable(queue, 0)
 	require.Nil(t, err)
 	assertKey(t, ewAvail.byArb, id)
 	assertKey(t, ewAvail.byExp, id)
@@ -91,6 +98,121 @@ func TestQAdd(t *T) {
 	e, err := testPeel.c.GetEvent(id)
 	require.Nil(t, err)
 	assert.Equal(t, contents, e.Contents)
+	assert.Equal(t, headers, e.Headers)
+}
+
+func TestQAddScheduled(t *T) {
+	queue := testutil.RandStr()
+	cgroup := testutil.RandStr()
+	now := time.Now()
+
+	ewAvail, err := queueAvailable(queue, 0)
+	require.Nil(t, err)
+	ewSched, err := queueScheduled(queue, 0)
+	require.Nil(t, err)
+
+	available := now.Add(100 * time.Millisecond)
+	id, err := testPeel.QAdd(QAddCommand{
+		Queue:     queue,
+		Expire:    now.Add(10 * time.Second),
+		Contents:  testutil.RandStr(),
+		Available: available,
+	})
+	require.Nil(t, err)
+	assert.Equal(t, core.NewTS(available), id.T)
+	assertKey(t, ewAvail.byArb)
+	assertKey(t, ewSched.byArb, id)
+	assertKey(t, ewSched.byExp, id)
+
+	e, err := testPeel.QGet(QGetCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+	})
+	require.Nil(t, err)
+	assert.Equal(t, core.Event{}, e)
+
+	qsm, err := testPeel.QStatus(QStatusCommand{
+		QueuesConsumerGroups: map[string][]string{queue: {cgroup}},
+	})
+	require.Nil(t, err)
+	assert.Equal(t, uint64(0), qsm[queue].Total)
+	assert.Equal(t, uint64(1), qsm[queue].Scheduled)
+
+	// A blocking QGet should wake up when the event becomes available, even
+	// though nothing gets pushed
+	e, err = testPeel.QGet(QGetCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		BlockUntil:    now.Add(1 * time.Second),
+	})
+	require.Nil(t, err)
+	assert.Equal(t, id, e.ID)
+	assert.True(t, time.Now().After(available))
+	assert.True(t, time.Now().Before(now.Add(1*time.Second)))
+	assertKey(t, ewAvail.byArb, id)
+	assertKey(t, ewSched.byArb)
+	assertKey(t, ewSched.byExp)
+}
+
+func TestQAddDedup(t *T) {
+	o := testPeel.o
+	o.DedupWindow = 1 * time.Second
+	p := &Peel{c: testPeel.c, o: o}
+
+	queue := testutil.RandStr()
+	dedupKey := testutil.RandStr() + ":/+="
+	qadd := func(dedupKey string) core.ID {
+		id, err := p.QAdd(QAddCommand{
+			Queue:    queue,
+			Expire:   time.Now().Add(10 * time.Minute),
+			Contents: testutil.RandStr(),
+			DedupKey: dedupKey,
+		})
+		require.Nil(t, err)
+		return id
+	}
+
+	id1 := qadd(dedupKey)
+	assert.Equal(t, id1, qadd(dedupKey))
+	id2 := qadd(testutil.RandStr())
+	assert.NotEqual(t, id1, id2)
+
+	ewAvail, err := queueAvailable(queue, 0)
+	require.Nil(t, err)
+	assertKey(t, ewAvail.byArb, id1, id2)
+
+	// The dedup key shouldn't look like a consumer group
+	m, err := p.AllQueuesConsumerGroups()
+	require.Nil(t, err)
+	assert.Empty(t, m[queue])
+
+	time.Sleep(o.DedupWindow + 100*time.Millisecond)
+	id3 := qadd(dedupKey)
+	assert.NotEqual(t, id1, id3)
+	assertKey(t, ewAvail.byArb, id1, id2, id3)
+}
+
+func TestQAddBatch(t *T) {
+	queue := testutil.RandStr()
+	contents := []string{testutil.RandStr(), testutil.RandStr(), testutil.RandStr()}
+	ii, err := testPeel.QAddBatch(QAddBatchCommand{
+		Queue:    queue,
+		Expire:   time.Now().Add(10 * time.Second),
+		Contents: contents,
+	})
+	require.Nil(t, err)
+	require.Len(t, ii, len(contents))
+
+	ewAvail, err := queueAvailable(queue, 0)
+	require.Nil(t, err)
+	assertKey(t, ewAvail.byArb, ii...)
+	assertKey(t, ewAvail.byExp, ii...)
+
+	for i, id := range ii {
+		e, err := testPeel.c.GetEvent(id)
+		require.Nil(t, err)
+		assert.Equal(t, contents[i], e.Contents)
+	}
 }
 
 // score is optional
@@ -173,7 +295,7 @@ func TestQGet(t *T) {
 		t.Logf("ii[%d]: %d (%#v)", i, id, id)
 	}
 
-	ewInProg, ewRedo, keyPtr, err := queueCGroupKeys(queue, cgroup)
+	ewInProg, ewRedo, keyPtr, err := queueCGroupKeys(queue, cgroup, 0)
 	require.Nil(t, err)
 
 	// Test that a "blank" queue gives us its first event
@@ -315,6 +437,145 @@ func TestQGet(t *T) {
 	assertSingleKey(t, keyPtr, id)
 }
 
+func TestQGetBatch(t *T) {
+	queue, ii := newTestQueue(t, 6)
+	cgroup := testutil.RandStr()
+
+	ewInProg, ewRedo, keyPtr, err := queueCGroupKeys(queue, cgroup, 0)
+	require.Nil(t, err)
+
+	assertIDs := func(ee []core.Event, ii ...core.ID) {
+		eii := make([]core.ID, len(ee))
+		for i := range ee {
+			eii[i] = ee[i].ID
+		}
+		assert.Equal(t, ii, eii)
+	}
+
+	cmd := QGetCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		AckDeadline:   time.Now().Add(1 * time.Minute),
+		Count:         2,
+	}
+	ee, err := testPeel.QGetBatch(cmd)
+	require.Nil(t, err)
+	assertIDs(ee, ii[0], ii[1])
+	assertKey(t, ewInProg.byArb, ii[0], ii[1])
+	assertKey(t, ewInProg.byExp, ii[0], ii[1])
+	assertSingleKey(t, keyPtr, ii[1])
+
+	// Put the first event in redo, it should come back first, followed by
+	// events after the pointer
+	requireAddToKey(t, ewRedo.byArb, ii[0], 0)
+	requireAddToKey(t, ewRedo.byExp, ii[0], ii[0].Expire)
+	cmd.Count = 3
+	ee, err = testPeel.QGetBatch(cmd)
+	require.Nil(t, err)
+	assertIDs(ee, ii[0], ii[2], ii[3])
+	assertKey(t, ewInProg.byArb, ii[0], ii[1], ii[2], ii[3])
+	assertKey(t, ewRedo.byArb)
+	assertKey(t, ewRedo.byExp)
+	assertSingleKey(t, keyPtr, ii[3])
+
+	// Asking for more than are available returns what's left
+	cmd.Count = 10
+	ee, err = testPeel.QGetBatch(cmd)
+	require.Nil(t, err)
+	assertIDs(ee, ii[4], ii[5])
+	assertSingleKey(t, keyPtr, ii[5])
+
+	ee, err = testPeel.QGetBatch(cmd)
+	require.Nil(t, err)
+	assert.Empty(t, ee)
+	assertSingleKey(t, keyPtr, ii[5])
+}
+
+func TestQGetPriority(t *T) {
+	p := &Peel{c: testPeel.c, o: testPeel.o}
+	p.o.PriorityLevels = 3
+
+	queue := testutil.RandStr()
+	cgroup := testutil.RandStr()
+
+	qadd := func(priority int) core.ID {
+		id, err := p.QAdd(QAddCommand{
+			Queue:    queue,
+			Expire:   time.Now().Add(10 * time.Minute),
+			Contents: testutil.RandStr(),
+			Priority: priority,
+		})
+		require.Nil(t, err)
+		return id
+	}
+
+	_, err := p.QAdd(QAddCommand{
+		Queue:    queue,
+		Expire:   time.Now().Add(10 * time.Minute),
+		Contents: testutil.RandStr(),
+		Priority: 3,
+	})
+	assert.Equal(t, ErrInvalidPriority, err)
+
+	low := qadd(0)
+	high0 := qadd(2)
+	mid := qadd(1)
+	high1 := qadd(2)
+
+	cmd := QGetCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		AckDeadline:   time.Now().Add(1 * time.Minute),
+		Count:         10,
+	}
+
+	// Batches don't span priority levels
+	ee, err := p.QGetBatch(cmd)
+	require.Nil(t, err)
+	require.Len(t, ee, 2)
+	assert.Equal(t, high0, ee[0].ID)
+	assert.Equal(t, high1, ee[1].ID)
+
+	// Nacking a high priority event puts it back ahead of the lower priority
+	// ones
+	nacked, err := p.QNack(QNackCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		EventID:       high1,
+	})
+	require.Nil(t, err)
+	assert.True(t, nacked)
+
+	cmd.Count = 1
+	for _, id := range []core.ID{high1, mid, low} {
+		e, err := p.QGet(cmd)
+		require.Nil(t, err)
+		assert.Equal(t, id, e.ID)
+	}
+
+	e, err := p.QGet(cmd)
+	require.Nil(t, err)
+	assert.Equal(t, core.Event{}, e)
+
+	// Events can be acked no matter their priority
+	for _, id := range []core.ID{low, high0} {
+		acked, err := p.QAck(QAckCommand{
+			Queue:         queue,
+			ConsumerGroup: cgroup,
+			EventID:       id,
+		})
+		require.Nil(t, err)
+		assert.True(t, acked)
+	}
+
+	qsm, err := p.QStatus(QStatusCommand{
+		QueuesConsumerGroups: map[string][]string{queue: {cgroup}},
+	})
+	require.Nil(t, err)
+	assert.Equal(t, uint64(4), qsm[queue].Total)
+	assert.Equal(t, uint64(2), qsm[queue].ConsumerGroupStats[cgroup].InProgress)
+}
+
 func TestQGetBlocking(t *T) {
 	queue, ii := newTestQueue(t, 1)
 	cgroup := testutil.RandStr()
@@ -373,13 +634,106 @@ func TestQGetBlocking(t *T) {
 	e = assertBlockFor(500 * time.Millisecond)
 	e2 := <-e2ch
 	assert.Equal(t, e2, e)
+
+	// Closing StopCh should cause an early return with no event
+	stopCh := make(chan struct{})
+	cmd.BlockUntil = time.Now().Add(10 * time.Second)
+	cmd.StopCh = stopCh
+	time.AfterFunc(500*time.Millisecond, func() { close(stopCh) })
+	e = assertBlockFor(500 * time.Millisecond)
+	assert.Equal(t, core.Event{}, e)
+}
+
+func TestQPeek(t *T) {
+	queue, ii := newTestQueue(t, 4)
+	cgroup := testutil.RandStr()
+
+	ewInProg, ewRedo, keyPtr, err := queueCGroupKeys(queue, cgroup, 0)
+	require.Nil(t, err)
+
+	assertPeek := func(count int, ii ...core.ID) {
+		ee, err := testPeel.QPeek(QPeekCommand{
+			Queue:         queue,
+			ConsumerGroup: cgroup,
+			Count:         count,
+		})
+		require.Nil(t, err)
+		eii := make([]core.ID, len(ee))
+		for i := range ee {
+			eii[i] = ee[i].ID
+		}
+		assert.Equal(t, ii, eii)
+	}
+
+	assertPeek(0, ii[0])
+	assertPeek(2, ii[0], ii[1])
+	assertSingleKey(t, keyPtr)
+
+	// Peeking twice shouldn't change anything
+	assertPeek(2, ii[0], ii[1])
+
+	// Move the pointer and put something in redo, the redo event should come
+	// first
+	requireSetSingleKey(t, keyPtr, ii[1])
+	requireAddToKey(t, ewRedo.byArb, ii[0], 0)
+	requireAddToKey(t, ewRedo.byExp, ii[0], ii[0].Expire)
+	assertPeek(10, ii[0], ii[2], ii[3])
+	assertPeek(2, ii[0], ii[2])
+
+	assertSingleKey(t, keyPtr, ii[1])
+	assertKey(t, ewRedo.byArb, ii[0])
+	assertKey(t, ewInProg.byArb)
+}
+
+func TestQSeek(t *T) {
+	queue, ii := newTestQueue(t, 4)
+	cgroup := testutil.RandStr()
+
+	_, ewRedo, keyPtr, err := queueCGroupKeys(queue, cgroup, 0)
+	require.Nil(t, err)
+
+	seek := func(c QSeekCommand) {
+		c.Queue = queue
+		c.ConsumerGroup = cgroup
+		require.Nil(t, testPeel.QSeek(c))
+	}
+
+	seek(QSeekCommand{EventID: ii[2]})
+	assertSingleKey(t, keyPtr, ii[1])
+
+	seek(QSeekCommand{EventID: ii[0]})
+	assertSingleKey(t, keyPtr)
+
+	seek(QSeekCommand{Time: ii[3].T.Time()})
+	assertSingleKey(t, keyPtr, ii[2])
+
+	seek(QSeekCommand{Latest: true})
+	assertSingleKey(t, keyPtr, ii[3])
+
+	requireAddToKey(t, ewRedo.byArb, ii[0], 0)
+	requireAddToKey(t, ewRedo.byExp, ii[0], ii[0].Expire)
+	seek(QSeekCommand{})
+	assertSingleKey(t, keyPtr)
+	assertKey(t, ewRedo.byArb, ii[0])
+
+	seek(QSeekCommand{EventID: ii[1], ClearRedo: true})
+	assertSingleKey(t, keyPtr, ii[0])
+	assertKey(t, ewRedo.byArb)
+	assertKey(t, ewRedo.byExp)
+
+	e, err := testPeel.QGet(QGetCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+	})
+	require.Nil(t, err)
+	assert.Equal(t, ii[1], e.ID)
 }
 
 func TestQAck(t *T) {
 	queue, ii := newTestQueue(t, 2)
 	cgroup := testutil.RandStr()
 
-	ewInProg, _, _, err := queueCGroupKeys(queue, cgroup)
+	ewInProg, _, _, err := queueCGroupKeys(queue, cgroup, 0)
 	require.Nil(t, err)
 
 	ackDeadline := core.NewTS(ii[0].T.Time().Add(10 * time.Millisecond))
@@ -415,6 +769,226 @@ func TestQAck(t *T) {
 	assertKey(t, ewInProg.byExp, ii[1])
 }
 
+func TestQAckOwner(t *T) {
+	queue, ii := newTestQueue(t, 3)
+	cgroup := testutil.RandStr()
+	c1, c2 := testutil.RandStr(), testutil.RandStr()
+
+	get := func(consumer string) core.ID {
+		e, err := testPeel.QGet(QGetCommand{
+			Queue:         queue,
+			ConsumerGroup: cgroup,
+			AckDeadline:   time.Now().Add(1 * time.Minute),
+			Consumer:      consumer,
+		})
+		require.Nil(t, err)
+		return e.ID
+	}
+	ack := func(id core.ID, consumer string, force bool) (bool, error) {
+		return testPeel.QAck(QAckCommand{
+			Queue:         queue,
+			ConsumerGroup: cgroup,
+			EventID:       id,
+			Consumer:      consumer,
+			Force:         force,
+		})
+	}
+
+	// c1 gets the event and gives it up, and c2 picks it up. Only c2 may ack
+	// it now
+	require.Equal(t, ii[0], get(c1))
+	nacked, err := testPeel.QNack(QNackCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		EventID:       ii[0],
+		Consumer:      c1,
+	})
+	require.Nil(t, err)
+	require.True(t, nacked)
+	require.Equal(t, ii[0], get(c2))
+
+	acked, err := ack(ii[0], c1, false)
+	assert.Equal(t, NotOwnerError{Owner: c2}, err)
+	assert.False(t, acked)
+	acked, err = ack(ii[0], "", false)
+	assert.Equal(t, NotOwnerError{Owner: c2}, err)
+	assert.False(t, acked)
+	acked, err = ack(ii[0], c2, false)
+	require.Nil(t, err)
+	assert.True(t, acked)
+	acked, err = ack(ii[0], c2, false)
+	require.Nil(t, err)
+	assert.False(t, acked)
+
+	// Forcing allows anyone to ack
+	require.Equal(t, ii[1], get(c2))
+	acked, err = ack(ii[1], c1, true)
+	require.Nil(t, err)
+	assert.True(t, acked)
+
+	// Events retrieved without a consumer may be acked by anyone
+	require.Equal(t, ii[2], get(""))
+	acked, err = ack(ii[2], c1, false)
+	require.Nil(t, err)
+	assert.True(t, acked)
+}
+
+func TestQNackExtendOwner(t *T) {
+	queue, ii := newTestQueue(t, 1)
+	cgroup := testutil.RandStr()
+	c1, c2 := testutil.RandStr(), testutil.RandStr()
+
+	e, err := testPeel.QGet(QGetCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		AckDeadline:   time.Now().Add(1 * time.Minute),
+		Consumer:      c1,
+	})
+	require.Nil(t, err)
+	require.Equal(t, ii[0], e.ID)
+
+	extend := func(consumer string, force bool) (bool, error) {
+		return testPeel.QExtend(QExtendCommand{
+			Queue:         queue,
+			ConsumerGroup: cgroup,
+			EventID:       ii[0],
+			AckDeadline:   time.Now().Add(2 * time.Minute),
+			Consumer:      consumer,
+			Force:         force,
+		})
+	}
+	nack := func(consumer string, force bool) (bool, error) {
+		return testPeel.QNack(QNackCommand{
+			Queue:         queue,
+			ConsumerGroup: cgroup,
+			EventID:       ii[0],
+			Consumer:      consumer,
+			Force:         force,
+		})
+	}
+
+	extended, err := extend(c2, false)
+	assert.Equal(t, NotOwnerError{Owner: c1}, err)
+	assert.False(t, extended)
+	extended, err = extend("", false)
+	assert.Equal(t, NotOwnerError{Owner: c1}, err)
+	assert.False(t, extended)
+	extended, err = extend(c1, false)
+	require.Nil(t, err)
+	assert.True(t, extended)
+	extended, err = extend(c2, true)
+	require.Nil(t, err)
+	assert.True(t, extended)
+
+	nacked, err := nack(c2, false)
+	assert.Equal(t, NotOwnerError{Owner: c1}, err)
+	assert.False(t, nacked)
+	nacked, err = nack(c2, true)
+	require.Nil(t, err)
+	assert.True(t, nacked)
+
+	// Once it's not in progress there's no owner to speak of
+	nacked, err = nack(c2, false)
+	require.Nil(t, err)
+	assert.False(t, nacked)
+}
+
+func TestQNack(t *T) {
+	queue, ii := newTestQueue(t, 2)
+	cgroup := testutil.RandStr()
+
+	ewInProg, ewRedo, _, err := queueCGroupKeys(queue, cgroup, 0)
+	require.Nil(t, err)
+
+	requireAddToKey(t, ewInProg.byArb, ii[0], core.NewTS(time.Now().Add(1*time.Minute)))
+	requireAddToKey(t, ewInProg.byExp, ii[0], ii[0].Expire)
+
+	cmd := QNackCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		EventID:       ii[0],
+	}
+	nacked, err := testPeel.QNack(cmd)
+	require.Nil(t, err)
+	assert.True(t, nacked)
+	assertKey(t, ewInProg.byArb)
+	assertKey(t, ewInProg.byExp)
+	assertKey(t, ewRedo.byArb, ii[0])
+	assertKey(t, ewRedo.byExp, ii[0])
+
+	// The event should be the next one retrieved
+	e, err := testPeel.QGet(QGetCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+	})
+	require.Nil(t, err)
+	assert.Equal(t, ii[0], e.ID)
+
+	// Nacking an event which isn't in progress does nothing
+	nacked, err = testPeel.QNack(cmd)
+	require.Nil(t, err)
+	assert.False(t, nacked)
+	assertKey(t, ewRedo.byArb)
+
+	// Nor does nacking one whose deadline has passed
+	requireAddToKey(t, ewInProg.byArb, ii[1], core.NewTS(time.Now().Add(-10*time.Millisecond)))
+	requireAddToKey(t, ewInProg.byExp, ii[1], ii[1].Expire)
+	cmd.EventID = ii[1]
+	nacked, err = testPeel.QNack(cmd)
+	require.Nil(t, err)
+	assert.False(t, nacked)
+	assertKey(t, ewInProg.byArb, ii[1])
+	assertKey(t, ewRedo.byArb)
+}
+
+func TestQExtend(t *T) {
+	queue, ii := newTestQueue(t, 1)
+	cgroup := testutil.RandStr()
+
+	ewInProg, err := queueInProgress(queue, cgroup, 0)
+	require.Nil(t, err)
+
+	e, err := testPeel.QGet(QGetCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		AckDeadline:   time.Now().Add(50 * time.Millisecond),
+	})
+	require.Nil(t, err)
+	assert.Equal(t, ii[0], e.ID)
+
+	cmd := QExtendCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		EventID:       ii[0],
+		AckDeadline:   time.Now().Add(1 * time.Minute),
+	}
+	extended, err := testPeel.QExtend(cmd)
+	require.Nil(t, err)
+	assert.True(t, extended)
+
+	// The original deadline has passed, but the event should still be in
+	// progress and ackable
+	time.Sleep(100 * time.Millisecond)
+	require.Nil(t, testPeel.Clean(queue, cgroup))
+	assertKey(t, ewInProg.byArb, ii[0])
+	assertKey(t, ewInProg.byExp, ii[0])
+
+	acked, err := testPeel.QAck(QAckCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		EventID:       ii[0],
+	})
+	require.Nil(t, err)
+	assert.True(t, acked)
+
+	// Extending an event which isn't in progress does nothing
+	extended, err = testPeel.QExtend(cmd)
+	require.Nil(t, err)
+	assert.False(t, extended)
+	assertKey(t, ewInProg.byArb)
+	assertKey(t, ewInProg.byExp)
+}
+
 func TestClean(t *T) {
 	queue, ii := newTestQueue(t, 6)
 	cgroup := testutil.RandStr()
@@ -424,7 +998,7 @@ func TestClean(t *T) {
 		t.Logf("ii[%d]: %d (%#v)", i, id, id)
 	}
 
-	ewInProg, ewRedo, keyPtr, err := queueCGroupKeys(queue, cgroup)
+	ewInProg, ewRedo, keyPtr, err := queueCGroupKeys(queue, cgroup, 0)
 	require.Nil(t, err)
 
 	// in progress, has neither expired nor missed its deadline
@@ -467,10 +1041,280 @@ func TestClean(t *T) {
 	assertSingleKey(t, keyPtr)
 }
 
+func TestMaxDeliveries(t *T) {
+	p := &Peel{c: testPeel.c, o: testPeel.o}
+	p.o.MaxDeliveries = 2
+
+	queue, ii := newTestQueue(t, 1)
+	cgroup := testutil.RandStr()
+
+	ewInProg, ewRedo, _, err := queueCGroupKeys(queue, cgroup, 0)
+	require.Nil(t, err)
+	ewDeliv, ewDead, err := queueCGroupRetryKeys(queue, cgroup)
+	require.Nil(t, err)
+
+	// First delivery is nacked, so it goes to redo
+	e, err := p.QGet(QGetCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		AckDeadline:   time.Now().Add(1 * time.Minute),
+	})
+	require.Nil(t, err)
+	assert.Equal(t, ii[0], e.ID)
+	assertKey(t, ewDeliv.byArb, ii[0])
+
+	nacked, err := p.QNack(QNackCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		EventID:       ii[0],
+	})
+	require.Nil(t, err)
+	assert.True(t, nacked)
+	assertKey(t, ewRedo.byArb, ii[0])
+	assertKey(t, ewDead.byArb)
+
+	// Second delivery misses its deadline, so it goes to dead
+	e, err = p.QGet(QGetCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		AckDeadline:   time.Now().Add(10 * time.Millisecond),
+	})
+	require.Nil(t, err)
+	assert.Equal(t, ii[0], e.ID)
+
+	time.Sleep(50 * time.Millisecond)
+	require.Nil(t, p.Clean(queue, cgroup))
+	assertKey(t, ewInProg.byArb)
+	assertKey(t, ewRedo.byArb)
+	assertKey(t, ewDeliv.byArb)
+	assertKey(t, ewDeliv.byExp)
+	assertKey(t, ewDead.byArb, ii[0])
+	assertKey(t, ewDead.byExp, ii[0])
+
+	e, err = p.QGet(QGetCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+	})
+	require.Nil(t, err)
+	assert.Equal(t, core.Event{}, e)
+
+	qsm, err := p.QStatus(QStatusCommand{
+		QueuesConsumerGroups: map[string][]string{queue: {cgroup}},
+	})
+	require.Nil(t, err)
+	assert.Equal(t, uint64(1), qsm[queue].ConsumerGroupStats[cgroup].Dead)
+}
+
+func TestDeleteConsumerGroup(t *T) {
+	queue, ii := newTestQueue(t, 3)
+	cg1 := testutil.RandStr()
+	cg2 := testutil.RandStr()
+
+	for _, cg := range []string{cg1, cg2} {
+		ee, err := testPeel.QGetBatch(QGetCommand{
+			Queue:         queue,
+			ConsumerGroup: cg,
+			AckDeadline:   time.Now().Add(1 * time.Minute),
+			Count:         2,
+		})
+		require.Nil(t, err)
+		require.Len(t, ee, 2)
+	}
+
+	nacked, err := testPeel.QNack(QNackCommand{
+		Queue:         queue,
+		ConsumerGroup: cg1,
+		EventID:       ii[0],
+	})
+	require.Nil(t, err)
+	assert.True(t, nacked)
+
+	m, err := testPeel.AllQueuesConsumerGroups()
+	require.Nil(t, err)
+	assert.Len(t, m[queue], 2)
+
+	require.Nil(t, testPeel.DeleteConsumerGroup(queue, cg1))
+
+	m, err = testPeel.AllQueuesConsumerGroups()
+	require.Nil(t, err)
+	assert.Equal(t, []string{cg2}, m[queue])
+
+	kk, err := testPeel.c.KeyScan(core.Key{Base: queue, Subs: []string{cg1, "*"}})
+	require.Nil(t, err)
+	assert.Empty(t, kk)
+
+	// The other consumer group and the queue itself shouldn't be affected
+	ewAvail, err := queueAvailable(queue, 0)
+	require.Nil(t, err)
+	assertKey(t, ewAvail.byArb, ii...)
+	ewInProg, _, _, err := queueCGroupKeys(queue, cg2, 0)
+	require.Nil(t, err)
+	assertKey(t, ewInProg.byArb, ii[0], ii[1])
+}
+
+func TestQRem(t *T) {
+	queue, ii := newTestQueue(t, 3)
+	cg1 := testutil.RandStr()
+	cg2 := testutil.RandStr()
+
+	// cg1 has ii[0] in progress, cg2 has it in redo
+	_, err := testPeel.QGet(QGetCommand{
+		Queue:         queue,
+		ConsumerGroup: cg1,
+		AckDeadline:   time.Now().Add(1 * time.Minute),
+	})
+	require.Nil(t, err)
+	_, err = testPeel.QGet(QGetCommand{
+		Queue:         queue,
+		ConsumerGroup: cg2,
+		AckDeadline:   time.Now().Add(1 * time.Minute),
+	})
+	require.Nil(t, err)
+	nacked, err := testPeel.QNack(QNackCommand{
+		Queue:         queue,
+		ConsumerGroup: cg2,
+		EventID:       ii[0],
+	})
+	require.Nil(t, err)
+	require.True(t, nacked)
+
+	for _, id := range []core.ID{ii[0], ii[1]} {
+		removed, err := testPeel.QRem(QRemCommand{Queue: queue, EventID: id})
+		require.Nil(t, err)
+		assert.True(t, removed)
+	}
+
+	ewAvail, err := queueAvailable(queue, 0)
+	require.Nil(t, err)
+	assertKey(t, ewAvail.byArb, ii[2])
+	for _, cg := range []string{cg1, cg2} {
+		ewInProg, ewRedo, _, err := queueCGroupKeys(queue, cg, 0)
+		require.Nil(t, err)
+		assertKey(t, ewInProg.byArb)
+		assertKey(t, ewRedo.byArb)
+	}
+
+	ee, err := testPeel.c.GetEvents(ii)
+	require.Nil(t, err)
+	require.Len(t, ee, 1)
+	assert.Equal(t, ii[2], ee[0].ID)
+
+	// Removing again should find nothing
+	removed, err := testPeel.QRem(QRemCommand{Queue: queue, EventID: ii[0]})
+	require.Nil(t, err)
+	assert.False(t, removed)
+
+	// Removing another queue's event should leave it alone
+	otherQueue, otherII := newTestQueue(t, 1)
+	removed, err = testPeel.QRem(QRemCommand{Queue: queue, EventID: otherII[0]})
+	require.Nil(t, err)
+	assert.False(t, removed)
+	_, err = testPeel.c.GetEvent(otherII[0])
+	assert.Nil(t, err)
+	ewOtherAvail, err := queueAvailable(otherQueue, 0)
+	require.Nil(t, err)
+	assertKey(t, ewOtherAvail.byArb, otherII[0])
+
+	// Both consumer groups should skip straight to the remaining event
+	for _, cg := range []string{cg1, cg2} {
+		e, err := testPeel.QGet(QGetCommand{Queue: queue, ConsumerGroup: cg})
+		require.Nil(t, err)
+		assert.Equal(t, ii[2], e.ID)
+	}
+}
+
+func TestPurgeQueue(t *T) {
+	queue, ii := newTestQueue(t, 3)
+	cg := testutil.RandStr()
+
+	e, err := testPeel.QGet(QGetCommand{
+		Queue:         queue,
+		ConsumerGroup: cg,
+		AckDeadline:   time.Now().Add(1 * time.Minute),
+	})
+	require.Nil(t, err)
+	assert.Equal(t, ii[0], e.ID)
+
+	require.Nil(t, testPeel.PurgeQueue(queue))
+
+	ewAvail, err := queueAvailable(queue, 0)
+	require.Nil(t, err)
+	assertKey(t, ewAvail.byArb)
+	assertKey(t, ewAvail.byExp)
+
+	// The consumer group and its in progress event should still be around
+	m, err := testPeel.AllQueuesConsumerGroups()
+	require.Nil(t, err)
+	assert.Equal(t, []string{cg}, m[queue])
+	ewInProg, _, _, err := queueCGroupKeys(queue, cg, 0)
+	require.Nil(t, err)
+	assertKey(t, ewInProg.byArb, ii[0])
+
+	// New events should still be retrievable
+	id, err := testPeel.QAdd(QAddCommand{
+		Queue:    queue,
+		Expire:   time.Now().Add(10 * time.Minute),
+		Contents: testutil.RandStr(),
+	})
+	require.Nil(t, err)
+	e, err = testPeel.QGet(QGetCommand{Queue: queue, ConsumerGroup: cg})
+	require.Nil(t, err)
+	assert.Equal(t, id, e.ID)
+}
+
+func TestDeleteQueue(t *T) {
+	queue, ii := newTestQueue(t, 3)
+	cg := testutil.RandStr()
+
+	_, err := testPeel.QAdd(QAddCommand{
+		Queue:     queue,
+		Expire:    time.Now().Add(10 * time.Minute),
+		Contents:  testutil.RandStr(),
+		Available: time.Now().Add(1 * time.Minute),
+	})
+	require.Nil(t, err)
+
+	e, err := testPeel.QGet(QGetCommand{
+		Queue:         queue,
+		ConsumerGroup: cg,
+		AckDeadline:   time.Now().Add(1 * time.Minute),
+	})
+	require.Nil(t, err)
+	assert.Equal(t, ii[0], e.ID)
+
+	require.Nil(t, testPeel.DeleteQueue(queue))
+
+	kk, err := testPeel.c.KeyScan(core.Key{Base: queue, Subs: []string{"*"}})
+	require.Nil(t, err)
+	assert.Empty(t, kk)
+
+	ee, err := testPeel.c.GetEvents(ii)
+	require.Nil(t, err)
+	assert.Empty(t, ee)
+
+	m, err := testPeel.AllQueuesConsumerGroups()
+	require.Nil(t, err)
+	_, ok := m[queue]
+	assert.False(t, ok)
+
+	// Deleting a queue which doesn't exist is fine
+	assert.Nil(t, testPeel.DeleteQueue(queue))
+
+	// A queue name which looks like a glob can't be used to delete other
+	// queues which it would match
+	sibling, siblingII := newTestQueue(t, 1)
+	assert.NotNil(t, testPeel.DeleteQueue(sibling[:len(sibling)/2]+"*"))
+	_, err = testPeel.c.GetEvent(siblingII[0])
+	assert.Nil(t, err)
+	ewSiblingAvail, err := queueAvailable(sibling, 0)
+	require.Nil(t, err)
+	assertKey(t, ewSiblingAvail.byArb, siblingII[0])
+}
+
 func TestCleanAvailable(t *T) {
 	queue := testutil.RandStr()
 
-	ewAvail, err := queueAvailable(queue)
+	ewAvail, err := queueAvailable(queue, 0)
 	require.Nil(t, err)
 
 	ii0 := randID(t, false)
@@ -490,12 +1334,100 @@ func TestCleanAvailable(t *T) {
 	assertKey(t, ewAvail.byArb, ii0, ii2)
 }
 
+func TestQConsumers(t *T) {
+	queue, ii := newTestQueue(t, 3)
+	cgroup := testutil.RandStr()
+	c1, c2 := "a "+testutil.RandStr(), "b:"+testutil.RandStr()
+
+	ee, err := testPeel.QGetBatch(QGetCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		AckDeadline:   time.Now().Add(1 * time.Minute),
+		Count:         2,
+		Consumer:      c1,
+	})
+	require.Nil(t, err)
+	require.Len(t, ee, 2)
+
+	// c2 doesn't use a deadline, so it's seen but never holds any events
+	e, err := testPeel.QGet(QGetCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		Consumer:      c2,
+	})
+	require.Nil(t, err)
+	assert.Equal(t, ii[2], e.ID)
+
+	assertConsumers := func(inProgress ...uint64) {
+		css, err := testPeel.QConsumers(queue, cgroup)
+		require.Nil(t, err)
+		require.Len(t, css, len(inProgress))
+		for i, cs := range css {
+			assert.Equal(t, []string{c1, c2}[i], cs.Name)
+			assert.Equal(t, inProgress[i], cs.InProgress)
+			assert.WithinDuration(t, time.Now(), cs.LastSeen, 1*time.Second)
+		}
+	}
+	assertConsumers(2, 0)
+
+	acked, err := testPeel.QAck(QAckCommand{
+		Queue:         queue,
+		ConsumerGroup: cgroup,
+		EventID:       ii[0],
+		Consumer:      c1,
+	})
+	require.Nil(t, err)
+	assert.True(t, acked)
+	assertConsumers(1, 0)
+
+	// Consumer keys shouldn't look like consumer groups
+	m, err := testPeel.AllQueuesConsumerGroups()
+	require.Nil(t, err)
+	assert.Equal(t, []string{cgroup}, m[queue])
+
+	// Cleaning doesn't affect c1's held event
+	require.Nil(t, testPeel.Clean(queue, cgroup))
+	ewOwners, err := queueOwners(queue, cgroup)
+	require.Nil(t, err)
+	assertKey(t, ewOwners.byArb, ii[1])
+	assertConsumers(1, 0)
+
+	require.Nil(t, testPeel.DeleteConsumerGroup(queue, cgroup))
+	assertConsumers()
+}
+
+func TestConsumerScore(t *T) {
+	queue, cgroup := testutil.RandStr(), testutil.RandStr()
+	c1, c2 := testutil.RandStr(), testutil.RandStr()
+
+	score := func(consumer string, seen bool) core.TS {
+		s, err := testPeel.consumerScore(queue, cgroup, consumer, seen)
+		require.Nil(t, err)
+		return s
+	}
+
+	// Consumers only get a score once they've been seen, after which it
+	// doesn't change, and no two consumers share one
+	assert.Zero(t, score(c1, false))
+	s1 := score(c1, true)
+	assert.NotZero(t, s1)
+	assert.Equal(t, s1, score(c1, false))
+	assert.Equal(t, s1, score(c1, true))
+
+	s2 := score(c2, true)
+	assert.NotZero(t, s2)
+	assert.NotEqual(t, s1, s2)
+
+	require.Nil(t, testPeel.DeleteConsumerGroup(queue, cgroup))
+	assert.Zero(t, score(c1, false))
+}
+
 func TestQStatus(t *T) {
 	queue, ii := newTestQueue(t, 6)
 	cg1 := testutil.RandStr()
 	cg2 := testutil.RandStr()
 
-	ewInProg, ewRedo, keyPtr, err := queueCGroupKeys(queue, cg1)
+	ewInProg, ewRedo, keyPtr, err := queueCGroupKeys(queue, cg1, 0)
 	require.Nil(t, err)
 
 	requireAddToKey(t, ewInProg.byArb, ii[0], core.NewTS(time.Now().Add(1*time.Minute)))
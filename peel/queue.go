@@ -1,7 +1,9 @@
 package peel
 
 import (
+	"encoding/base64"
 	"fmt"
+	"strconv"
 	"strings"
 
 	"github.com/mediocregopher/bananaq/core"
@@ -11,9 +13,11 @@ import (
 // safe for use in core. What they actually do is not important
 
 func queueKeyMarshal(k core.Key) (core.Key, error) {
+	// ':' separates key parts, and the rest have special meaning in the
+	// patterns used when scanning for keys
 	validateKeyPt := func(s string) error {
-		if strings.Contains(s, ":") {
-			return fmt.Errorf("key part %q contains invalid character ':'", s)
+		if i := strings.IndexAny(s, ":*?[]\\"); i >= 0 {
+			return fmt.Errorf("key part %q contains invalid character %q", s, s[i])
 		}
 		return nil
 	}
@@ -39,23 +43,101 @@ func queueKeyUnmarshal(k core.Key) (core.Key, error) {
 	return k, nil
 }
 
+// The first subs of keys which belong to the queue as a whole. Consumer group
+// keys are distinguished from these by their first sub being the group's name,
+// so these can't be used as consumer group names
+var queueKeySubs = map[string]bool{
+	"available": true,
+	"scheduled": true,
+	"dedup":     true,
+	"sizes":     true,
+}
+
+// Like queueKeyMarshal, but for a key belonging to the given consumer group.
+// The group's name is prepended to the subs, after making sure it isn't one
+// which would be mistaken for a queue key
+func cgroupKeyMarshal(queue, cgroup string, subs ...string) (core.Key, error) {
+	if queueKeySubs[cgroup] {
+		return core.Key{}, fmt.Errorf("consumer group name %q is reserved", cgroup)
+	}
+	return queueKeyMarshal(core.Key{Base: queue, Subs: append([]string{cgroup}, subs...)})
+}
+
+// Some keys are kept separately for each priority level. Level 0 doesn't get
+// anything added to its subs, so that keys created before there were priority
+// levels are still valid at that level
+func prioritySubs(priority int, subs ...string) []string {
+	if priority == 0 {
+		return subs
+	}
+	return append(subs, "p"+strconv.Itoa(priority))
+}
+
 // Keeps track of events which are available to be retrieved by any particular
 // consumer group, with scores corresponding to the event's id.
-func queueAvailable(queue string) (exWrap, error) {
-	k, err := queueKeyMarshal(core.Key{Base: queue, Subs: []string{"available"}})
+func queueAvailable(queue string, priority int) (exWrap, error) {
+	k, err := queueKeyMarshal(core.Key{Base: queue, Subs: prioritySubs(priority, "available")})
+	if err != nil {
+		return exWrap{}, err
+	}
+	return newExWrap(k), nil
+}
+
+// Keeps track of events which have been added to the queue but won't be
+// available to any consumer group until some point in the future. Scores
+// correspond to the event's id, which is also the time it becomes available.
+func queueScheduled(queue string, priority int) (exWrap, error) {
+	k, err := queueKeyMarshal(core.Key{Base: queue, Subs: prioritySubs(priority, "scheduled")})
 	if err != nil {
 		return exWrap{}, err
 	}
 	return newExWrap(k), nil
 }
 
+// Single key, notified whenever an event is added to the queue at any priority
+// level so that consumers blocking on the queue wake up. This is the level 0
+// available key, since that's the key which was notified before there were
+// priority levels
+func queueNotify(queue string) (core.Key, error) {
+	ewAvail, err := queueAvailable(queue, 0)
+	return ewAvail.byArb, err
+}
+
+// Single key, holding the ID of the event which was added to the queue with the
+// given dedup key. The key expires once the dedup window has passed. The dedup
+// key is encoded since it may contain any characters
+func queueDedup(queue, dedupKey string) (core.Key, error) {
+	enc := base64.RawURLEncoding.EncodeToString([]byte(dedupKey))
+	return queueKeyMarshal(core.Key{Base: queue, Subs: []string{"dedup", enc}})
+}
+
+// Keeps track of every event in the queue, whether available or scheduled and
+// at any priority level, with scores corresponding to the event's id. The size
+// of each event (see eventSize), and the total of those sizes, are kept
+// alongside it. Only events added while the queue has QueueLimits are tracked.
+// Used to enforce those limits
+func queueSizes(queue string) (sizesWrap, error) {
+	k, err := queueKeyMarshal(core.Key{Base: queue, Subs: []string{"sizes"}})
+	if err != nil {
+		return sizesWrap{}, err
+	}
+	return newSizesWrap(k), nil
+}
+
+// Single key, notified whenever events are removed from the queue other than by
+// expiring, so that producers waiting for room in the queue wake up
+func queueSpace(queue string) (core.Key, error) {
+	ewSizes, err := queueSizes(queue)
+	return ewSizes.byArb, err
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 
 // Keeps track of events that are currently in progress, with scores
 // corresponding to the event's ack deadline. Used to timeout in progress events
 // and put them in redo
-func queueInProgress(queue, cgroup string) (exWrap, error) {
-	k, err := queueKeyMarshal(core.Key{Base: queue, Subs: []string{cgroup, "inprogress"}})
+func queueInProgress(queue, cgroup string, priority int) (exWrap, error) {
+	k, err := cgroupKeyMarshal(queue, cgroup, prioritySubs(priority, "inprogress")...)
 	if err != nil {
 		return exWrap{}, err
 	}
@@ -64,32 +146,88 @@ func queueInProgress(queue, cgroup string) (exWrap, error) {
 
 // Keeps track of events which were previously attempted to be processed but
 // failed. Score is the event's id
-func queueRedo(queue, cgroup string) (exWrap, error) {
-	k, err := queueKeyMarshal(core.Key{Base: queue, Subs: []string{cgroup, "redo"}})
+func queueRedo(queue, cgroup string, priority int) (exWrap, error) {
+	k, err := cgroupKeyMarshal(queue, cgroup, prioritySubs(priority, "redo")...)
 	if err != nil {
 		return exWrap{}, err
 	}
 	return newExWrap(k), nil
 }
 
+// Keeps track of how many times each event has been retrieved with an ack
+// deadline by the cgroup, with scores corresponding to that count. Used to
+// determine when an event should stop being redone
+func queueDeliveries(queue, cgroup string) (exWrap, error) {
+	k, err := cgroupKeyMarshal(queue, cgroup, "deliveries")
+	if err != nil {
+		return exWrap{}, err
+	}
+	return newExWrap(k), nil
+}
+
+// Keeps track of events which missed their ack deadline too many times, and so
+// will not be redone by the cgroup. Score is the event's id
+func queueDead(queue, cgroup string) (exWrap, error) {
+	k, err := cgroupKeyMarshal(queue, cgroup, "dead")
+	if err != nil {
+		return exWrap{}, err
+	}
+	return newExWrap(k), nil
+}
+
+// Keeps track of which named consumer in the cgroup holds each event which was
+// retrieved by one with an ack deadline, with scores corresponding to the
+// consumer's score (see queueConsumerScore). Events may linger here after they're no longer in
+// progress, so an event is only held by a consumer if it's in the cgroup's
+// inprogress set as well
+func queueOwners(queue, cgroup string) (exWrap, error) {
+	k, err := cgroupKeyMarshal(queue, cgroup, "owners")
+	if err != nil {
+		return exWrap{}, err
+	}
+	return newExWrap(k), nil
+}
+
+// Single key, holding an ID whose T is the last time the named consumer in the
+// cgroup retrieved events. The key expires ConsumerExpire after that, at which
+// point the consumer is forgotten. The consumer name is encoded since it may
+// contain any characters
+func queueConsumerSeen(queue, cgroup, consumer string) (core.Key, error) {
+	enc := base64.RawURLEncoding.EncodeToString([]byte(consumer))
+	return cgroupKeyMarshal(queue, cgroup, "consumer", enc, "seen")
+}
+
+// The Expire given to IDs holding consumer scores. The keys holding them expire
+// along with the consumer, so the IDs themselves never need to
+var consumerScoreExpire = core.TS(1 << 52)
+
+// Single key, holding an ID whose T is the score used for the named consumer in
+// the cgroup's owners set. The score is taken from a freshly generated ID the
+// first time the consumer retrieves events, so no two consumers share one. The
+// key expires along with the consumer's seen key
+func queueConsumerScore(queue, cgroup, consumer string) (core.Key, error) {
+	enc := base64.RawURLEncoding.EncodeToString([]byte(consumer))
+	return cgroupKeyMarshal(queue, cgroup, "consumer", enc, "score")
+}
+
 // Single key, used to keep track of newest event retrieved from avail by the
 // cgroup
-func queuePointer(queue, cgroup string) (core.Key, error) {
-	return queueKeyMarshal(core.Key{Base: queue, Subs: []string{cgroup, "ptr"}})
+func queuePointer(queue, cgroup string, priority int) (core.Key, error) {
+	return cgroupKeyMarshal(queue, cgroup, prioritySubs(priority, "ptr")...)
 }
 
-func queueCGroupKeys(queue, cgroup string) (exWrap, exWrap, core.Key, error) {
-	ewInProg, err := queueInProgress(queue, cgroup)
+func queueCGroupKeys(queue, cgroup string, priority int) (exWrap, exWrap, core.Key, error) {
+	ewInProg, err := queueInProgress(queue, cgroup, priority)
 	if err != nil {
 		return exWrap{}, exWrap{}, core.Key{}, err
 	}
 
-	ewRedo, err := queueRedo(queue, cgroup)
+	ewRedo, err := queueRedo(queue, cgroup, priority)
 	if err != nil {
 		return exWrap{}, exWrap{}, core.Key{}, err
 	}
 
-	keyPtr, err := queuePointer(queue, cgroup)
+	keyPtr, err := queuePointer(queue, cgroup, priority)
 	if err != nil {
 		return exWrap{}, exWrap{}, core.Key{}, err
 	}
@@ -97,6 +235,95 @@ func queueCGroupKeys(queue, cgroup string) (exWrap, exWrap, core.Key, error) {
 	return ewInProg, ewRedo, keyPtr, nil
 }
 
+func queueCGroupRetryKeys(queue, cgroup string) (exWrap, exWrap, error) {
+	ewDeliv, err := queueDeliveries(queue, cgroup)
+	if err != nil {
+		return exWrap{}, exWrap{}, err
+	}
+
+	ewDead, err := queueDead(queue, cgroup)
+	if err != nil {
+		return exWrap{}, exWrap{}, err
+	}
+
+	return ewDeliv, ewDead, nil
+}
+
+// Returns the consumer group the given unmarshalled key belongs to, or false if
+// it belongs to the queue as a whole
+func keyConsumerGroup(k core.Key) (string, bool) {
+	if queueKeySubs[k.Subs[0]] {
+		return "", false
+	}
+	return k.Subs[0], true
+}
+
+// Returns the name of the consumer the given unmarshalled key is the seen key
+// for, or false if it isn't a consumer's seen key
+func keyConsumer(k core.Key) (string, bool) {
+	if len(k.Subs) != 4 || k.Subs[1] != "consumer" || k.Subs[3] != "seen" {
+		return "", false
+	}
+	name, err := base64.RawURLEncoding.DecodeString(k.Subs[2])
+	if err != nil {
+		return "", false
+	}
+	return string(name), true
+}
+
+// Returns all consumers in the given consumer group which haven't expired
+func (p Peel) queueConsumers(queue, cgroup string) ([]string, error) {
+	// Make sure the consumer group name is valid before scanning with it
+	if _, err := cgroupKeyMarshal(queue, cgroup); err != nil {
+		return nil, err
+	}
+
+	kk, err := p.c.KeyScan(core.Key{Base: queue, Subs: []string{cgroup, "consumer", "*"}})
+	if err != nil {
+		return nil, err
+	}
+
+	var consumers []string
+	for _, k := range kk {
+		if k, err = queueKeyUnmarshal(k); err != nil {
+			return nil, err
+		}
+		if name, ok := keyConsumer(k); ok {
+			consumers = append(consumers, name)
+		}
+	}
+	return consumers, nil
+}
+
+// Returns all consumer groups which have keys on the given queue
+func (p Peel) queueConsumerGroups(queue string) ([]string, error) {
+	// Make sure the queue name is valid before scanning with it
+	if _, err := queueKeyMarshal(core.Key{Base: queue}); err != nil {
+		return nil, err
+	}
+
+	kk, err := p.c.KeyScan(core.Key{Base: queue, Subs: []string{"*"}})
+	if err != nil {
+		return nil, err
+	}
+
+	cgm := map[string]struct{}{}
+	for _, k := range kk {
+		if k, err = queueKeyUnmarshal(k); err != nil {
+			return nil, err
+		}
+		if cg, ok := keyConsumerGroup(k); ok {
+			cgm[cg] = struct{}{}
+		}
+	}
+
+	cgs := make([]string, 0, len(cgm))
+	for cg := range cgm {
+		cgs = append(cgs, cg)
+	}
+	return cgs, nil
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 
 // AllQueuesConsumerGroups returns a map whose keys are all the currently known
@@ -116,10 +343,9 @@ func (p Peel) AllQueuesConsumerGroups() (map[string][]string, error) {
 		if m[k.Base] == nil {
 			m[k.Base] = map[string]struct{}{}
 		}
-		if k.Subs[0] == "available" {
-			continue
+		if cg, ok := keyConsumerGroup(k); ok {
+			m[k.Base][cg] = struct{}{}
 		}
-		m[k.Base][k.Subs[0]] = struct{}{}
 	}
 
 	outm := map[string][]string{}
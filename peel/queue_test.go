@@ -2,6 +2,7 @@ package peel
 
 import (
 	. "testing"
+	"time"
 
 	"github.com/levenlabs/golib/testutil"
 	"github.com/mediocregopher/bananaq/core"
@@ -39,18 +40,18 @@ func TestAllQueuesCGroups(t *T) {
 	cg2 := testutil.RandStr()
 	cg3 := testutil.RandStr()
 
-	ewAvail1, err := queueAvailable(q1)
+	ewAvail1, err := queueAvailable(q1, 0)
 	require.Nil(t, err)
-	ewAvail2, err := queueAvailable(q2)
+	ewAvail2, err := queueAvailable(q2, 0)
 	require.Nil(t, err)
-	ewAvail3, err := queueAvailable(q3)
+	ewAvail3, err := queueAvailable(q3, 1)
 	require.Nil(t, err)
 
-	ew11, err := queueInProgress(q1, cg1)
+	ew11, err := queueInProgress(q1, cg1, 0)
 	require.Nil(t, err)
-	ew12, err := queueRedo(q1, cg2)
+	ew12, err := queueRedo(q1, cg2, 1)
 	require.Nil(t, err)
-	ew23, err := queueInProgress(q2, cg3)
+	ew23, err := queueInProgress(q2, cg3, 0)
 	require.Nil(t, err)
 
 	requireAddToKey(t, ewAvail1.byArb)
@@ -68,3 +69,27 @@ func TestAllQueuesCGroups(t *T) {
 	assert.Contains(t, m[q2], cg3)
 	assert.Empty(t, m[q3])
 }
+
+func TestReservedConsumerGroups(t *T) {
+	queue := testutil.RandStr()
+	id, err := testPeel.QAdd(QAddCommand{
+		Queue:    queue,
+		Expire:   time.Now().Add(10 * time.Second),
+		Contents: testutil.RandStr(),
+	})
+	require.Nil(t, err)
+
+	for cgroup := range queueKeySubs {
+		_, err := testPeel.QGet(QGetCommand{
+			Queue:         queue,
+			ConsumerGroup: cgroup,
+		})
+		assert.NotNil(t, err, "cgroup:%q", cgroup)
+		assert.NotNil(t, testPeel.DeleteConsumerGroup(queue, cgroup), "cgroup:%q", cgroup)
+	}
+
+	// The queue's own keys must be untouched
+	ewAvail, err := queueAvailable(queue, 0)
+	require.Nil(t, err)
+	assertKey(t, ewAvail.byArb, id)
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/levenlabs/go-llog"
+	"github.com/mediocregopher/bananaq/core"
+	"github.com/mediocregopher/bananaq/peel"
+)
+
+// How long each QGetBatch made on behalf of a subscription blocks for. This
+// doesn't affect how quickly events are delivered, since blocking returns as
+// soon as any are available
+const subscribeBlock = 1 * time.Minute
+
+var errNotHTTP = errors.New("QSUBSCRIBE is not supported over http")
+
+// subscription delivers events from a queue to a single connection as they
+// become available, see QSUBSCRIBE in the README. It is created by qsubscribe,
+// and delivery begins once start is called.
+type subscription struct {
+	queue, group string
+	consumer     string
+	deadline     time.Duration // zero if events needn't be acked
+	maxInFlight  int
+
+	write func(interface{}) error
+	kv    llog.KV
+
+	l sync.Mutex
+	// events which have been delivered but not yet acked, and their deadlines
+	inFlight map[core.ID]time.Time
+	// written to (non-blocking) whenever an event is removed from inFlight
+	ackCh chan struct{}
+
+	stopOnce sync.Once
+	stopCh   chan struct{}
+	doneCh   chan struct{}
+}
+
+func qsubscribe(args []string) (interface{}, error) {
+	s := &subscription{
+		queue:       args[0],
+		group:       args[1],
+		maxInFlight: 1,
+		inFlight:    map[core.ID]time.Time{},
+		ackCh:       make(chan struct{}, 1),
+		stopCh:      make(chan struct{}),
+		doneCh:      make(chan struct{}),
+	}
+
+	err := parseOpts(args[2:], map[string]int{
+		"DEADLINE":     1,
+		"MAX-INFLIGHT": 1,
+		"CONSUMER":     1,
+	}, func(opt string, vals []string) error {
+		switch opt {
+		case "DEADLINE":
+			secs, err := strconv.ParseFloat(vals[0], 64)
+			if err != nil {
+				return err
+			} else if secs <= 0 {
+				return errors.New("DEADLINE must be greater than 0")
+			}
+			s.deadline = time.Duration(secs * float64(time.Second))
+		case "MAX-INFLIGHT":
+			var err error
+			if s.maxInFlight, err = strconv.Atoi(vals[0]); err != nil {
+				return err
+			} else if s.maxInFlight < 1 {
+				return errors.New("MAX-INFLIGHT must be at least 1")
+			}
+		case "CONSUMER":
+			s.consumer = vals[0]
+		}
+		return nil
+	})
+	if err != nil {
+		return err, nil
+	}
+
+	return s, nil
+}
+
+// start begins delivering events in the background, using the given function
+// to write them to the client. write must be safe to call concurrently with
+// any other writes to the client.
+func (s *subscription) start(write func(interface{}) error, kv llog.KV) {
+	s.write = write
+	s.kv = kv.Set("queue", s.queue).Set("consumerGroup", s.group)
+
+	go s.run()
+	go func() {
+		select {
+		case <-shutdownCh:
+			s.stop()
+		case <-s.doneCh:
+		}
+	}()
+}
+
+// stop stops delivering events, and only returns once no more will be written
+// to the client. It may be called more than once.
+func (s *subscription) stop() {
+	s.stopOnce.Do(func() { close(s.stopCh) })
+	<-s.doneCh
+}
+
+func (s *subscription) run() {
+	defer close(s.doneCh)
+	for {
+		select {
+		case <-s.stopCh:
+			return
+		default:
+		}
+
+		n := s.slots()
+		if n == 0 {
+			return
+		}
+
+		ee, deadline, err := s.get(n)
+		if err == errShuttingDown {
+			return
+		} else if err != nil {
+			llog.Error("error getting events for subscription", s.kv, llog.KV{"err": err})
+			select {
+			case <-time.After(500 * time.Millisecond):
+			case <-s.stopCh:
+				return
+			}
+			continue
+		}
+
+		for _, e := range ee {
+			if s.deadline > 0 {
+				s.l.Lock()
+				s.inFlight[e.ID] = deadline
+				s.l.Unlock()
+			}
+			if err := s.write([]interface{}{"event", e.ID.String(), e.Contents}); err != nil {
+				llog.Warn("error writing event to subscription", s.kv, llog.KV{"err": err})
+				return
+			}
+		}
+	}
+}
+
+// slots blocks until there is room for more events to be in flight, and returns
+// how many more may be delivered. Returns 0 if the subscription is stopped
+// while waiting.
+func (s *subscription) slots() int {
+	if s.deadline == 0 {
+		return s.maxInFlight
+	}
+
+	for {
+		// Events whose deadline has passed will be redone by the consumer
+		// group, so they don't count against the limit anymore
+		now := time.Now()
+		var next time.Time
+		s.l.Lock()
+		for id, deadline := range s.inFlight {
+			if !deadline.After(now) {
+				delete(s.inFlight, id)
+			} else if next.IsZero() || deadline.Before(next) {
+				next = deadline
+			}
+		}
+		n := s.maxInFlight - len(s.inFlight)
+		s.l.Unlock()
+
+		if n > 0 {
+			return n
+		}
+
+		select {
+		case <-s.ackCh:
+		case <-time.After(next.Sub(now)):
+		case <-s.stopCh:
+			return 0
+		}
+	}
+}
+
+// get retrieves up to n events, blocking until at least one is available, and
+// returns them along with the deadline they were retrieved with. Like dispatch,
+// this refuses to do anything if the server is shutting down.
+func (s *subscription) get(n int) ([]core.Event, time.Time, error) {
+	inFlight.RLock()
+	defer inFlight.RUnlock()
+	select {
+	case <-shutdownCh:
+		return nil, time.Time{}, errShuttingDown
+	default:
+	}
+
+	now := time.Now()
+	c := peel.QGetCommand{
+		Queue:         s.queue,
+		ConsumerGroup: s.group,
+		BlockUntil:    now.Add(subscribeBlock),
+		StopCh:        s.stopCh,
+		Count:         n,
+		Consumer:      s.consumer,
+	}
+	if s.deadline > 0 {
+		c.AckDeadline = now.Add(s.deadline)
+	}
+
+	ee, err := p.QGetBatch(c)
+	return ee, c.AckDeadline, err
+}
+
+// dispatch handles a command sent by the client while subscribed. The return is
+// the same as for the package level dispatch.
+func (s *subscription) dispatch(cmd string, args []string) (interface{}, error) {
+	switch cmd {
+	case "PING":
+		return dispatch(cmd, args)
+	case "QACK", "QNACK", "QTOUCH":
+	default:
+		return fmt.Errorf("%s may not be used while subscribed", cmd), nil
+	}
+
+	if len(args) < 1 || (cmd == "QTOUCH" && len(args) < 2) {
+		return errors.New("insufficient arguments"), nil
+	}
+	id, err := core.IDFromString(args[0])
+	if err != nil {
+		return err, nil
+	}
+
+	// Commands are run as the subscription's consumer, if it has one
+	fullArgs := append([]string{s.queue, s.group}, args...)
+	if s.consumer != "" {
+		fullArgs = append(fullArgs, "CONSUMER", s.consumer)
+	}
+
+	ret, err := dispatch(cmd, fullArgs)
+	if ok, _ := ret.(bool); !ok || err != nil {
+		return ret, err
+	}
+
+	s.l.Lock()
+	defer s.l.Unlock()
+	if _, ok := s.inFlight[id]; !ok {
+		return ret, err
+	}
+
+	if cmd == "QTOUCH" {
+		// The deadline was already validated by dispatch
+		s.inFlight[id], _ = timeFromStr(time.Now(), args[1])
+		return ret, err
+	}
+
+	delete(s.inFlight, id)
+	select {
+	case s.ackCh <- struct{}{}:
+	default:
+	}
+	return ret, err
+}
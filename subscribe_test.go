@@ -0,0 +1,122 @@
+package main
+
+import (
+	. "testing"
+	"time"
+
+	"github.com/levenlabs/go-llog"
+	"github.com/levenlabs/golib/testutil"
+	"github.com/mediocregopher/bananaq/core"
+	"github.com/mediocregopher/bananaq/peel"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQSubscribeArgs(t *T) {
+	ret, err := qsubscribe([]string{"foo", "bar", "DEADLINE", "1.5", "MAX-INFLIGHT", "5", "CONSUMER", "baz"})
+	require.Nil(t, err)
+	s := ret.(*subscription)
+	assert.Equal(t, 1500*time.Millisecond, s.deadline)
+	assert.Equal(t, 5, s.maxInFlight)
+	assert.Equal(t, "baz", s.consumer)
+
+	ret, err = qsubscribe([]string{"foo", "bar"})
+	require.Nil(t, err)
+	s = ret.(*subscription)
+	assert.Equal(t, time.Duration(0), s.deadline)
+	assert.Equal(t, 1, s.maxInFlight)
+
+	ret, _ = qsubscribe([]string{"foo", "bar", "DEADLINE", "0"})
+	_, ok := ret.(error)
+	assert.True(t, ok)
+
+	ret, _ = qsubscribe([]string{"foo", "bar", "MAX-INFLIGHT", "0"})
+	_, ok = ret.(error)
+	assert.True(t, ok)
+
+	ret, err = qsubscribe([]string{"foo", "bar", "CONSUMER", "baz", "DEADLINE", "2"})
+	require.Nil(t, err)
+	s = ret.(*subscription)
+	assert.Equal(t, 2*time.Second, s.deadline)
+	assert.Equal(t, "baz", s.consumer)
+
+	ret, _ = qsubscribe([]string{"foo", "bar", "DEADLINE", "2", "WAT"})
+	_, ok = ret.(error)
+	assert.True(t, ok)
+}
+
+func TestSubscription(t *T) {
+	p = peel.New(core.NewMem(), nil)
+	queue, group := testutil.RandStr(), testutil.RandStr()
+
+	qadd := func() string {
+		id, err := p.QAdd(peel.QAddCommand{
+			Queue:    queue,
+			Expire:   time.Now().Add(1 * time.Minute),
+			Contents: testutil.RandStr(),
+		})
+		require.Nil(t, err)
+		return id.String()
+	}
+	id1, id2 := qadd(), qadd()
+
+	ret, err := qsubscribe([]string{queue, group, "DEADLINE", "10", "MAX-INFLIGHT", "1", "CONSUMER", testutil.RandStr()})
+	require.Nil(t, err)
+	s := ret.(*subscription)
+
+	writeCh := make(chan interface{}, 10)
+	s.start(func(m interface{}) error {
+		writeCh <- m
+		return nil
+	}, llog.KV{})
+	defer s.stop()
+
+	assertEvent := func(id string) {
+		select {
+		case m := <-writeCh:
+			ev := m.([]interface{})
+			assert.Equal(t, "event", ev[0])
+			assert.Equal(t, id, ev[1])
+		case <-time.After(1 * time.Second):
+			t.Fatalf("event %q not delivered", id)
+		}
+	}
+	assertNoEvent := func() {
+		select {
+		case m := <-writeCh:
+			t.Fatalf("unexpected write: %v", m)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	// Only one event may be in flight at a time
+	assertEvent(id1)
+	assertNoEvent()
+
+	ret, err = s.dispatch("QACK", []string{id1})
+	require.Nil(t, err)
+	assert.Equal(t, true, ret)
+	assertEvent(id2)
+
+	ret, err = s.dispatch("QNACK", []string{id2})
+	require.Nil(t, err)
+	assert.Equal(t, true, ret)
+	assertEvent(id2)
+	ret, err = s.dispatch("QACK", []string{id2})
+	require.Nil(t, err)
+	assert.Equal(t, true, ret)
+	assertNoEvent()
+
+	// Events added after subscribing are pushed as they come in
+	id3 := qadd()
+	assertEvent(id3)
+
+	ret, err = s.dispatch("QGET", []string{queue, group})
+	require.Nil(t, err)
+	_, ok := ret.(error)
+	assert.True(t, ok)
+
+	s.stop()
+	qadd()
+	assertNoEvent()
+}